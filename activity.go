@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ActivityCursor marks where a page of the activity feed ended, the next page starts right after it
+type ActivityCursor struct {
+	At time.Time
+	ID int64
+}
+
+// String encodes the cursor for the nextCursor field. it's opaque to clients, they only send it back
+func (c ActivityCursor) String() string {
+	raw := fmt.Sprintf("%d:%d", c.At.UnixMicro(), c.ID) // audit_log.at has microsecond precision
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// parseActivityCursor decodes what ActivityCursor.String made
+func parseActivityCursor(s string) (*ActivityCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", s)
+	}
+	at, id, ok := strings.Cut(string(raw), ":")
+	micros, err1 := strconv.ParseInt(at, 10, 64)
+	entryID, err2 := strconv.ParseInt(id, 10, 64)
+	if !ok || err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid cursor %q", s)
+	}
+	return &ActivityCursor{At: time.UnixMicro(micros).UTC(), ID: entryID}, nil
+}
+
+// ActivityResponse is GET /admin/activity, newest entries first. NextCursor is empty on the last page
+type ActivityResponse struct {
+	Data       []AuditEntry `json:"data"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// handleActivity returns the audit log across every account, newest first (admin only). it pages by keyset
+// instead of offset so entries written while an operator pages through don't shift or repeat what they see:
+// ?limit= sets the page size and ?cursor= (the previous page's nextCursor) picks up where that page ended
+func (s *APIServer) handleActivity(w http.ResponseWriter, req *http.Request) error {
+	return methods{
+		http.MethodGet: func() error {
+			if err := s.requireAdmin(req); err != nil {
+				return err
+			}
+
+			if req.URL.Query().Has("offset") {
+				return fmt.Errorf("the activity feed pages with ?cursor, not ?offset")
+			}
+			limit, _, err := s.parsePagination(w, req)
+			if err != nil {
+				return err
+			}
+
+			var after *ActivityCursor
+			if v := req.URL.Query().Get("cursor"); v != "" {
+				if after, err = parseActivityCursor(v); err != nil {
+					return err
+				}
+			}
+
+			// one extra entry tells us whether there's another page without counting the whole log
+			entries, err := s.store.GetActivity(req.Context(), after, limit+1)
+			if err != nil {
+				return err
+			}
+
+			resp := ActivityResponse{Data: entries}
+			if len(entries) > limit {
+				resp.Data = entries[:limit]
+				last := resp.Data[limit-1]
+				resp.NextCursor = ActivityCursor{At: last.At, ID: last.ID}.String()
+			}
+			return WriteJSON(w, http.StatusOK, resp)
+		},
+	}.serve(w, req)
+}
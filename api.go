@@ -1,161 +1,971 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
 	"net/http"
+	"reflect"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // APIServer is a simple HTTP server that listens for incoming requests
 type APIServer struct {
 	listenAddr string
 	store      AccountStore
+	events     *EventBus[AccountEvent]
+	cfg        *Config
+	httpServer *http.Server // created up front so Shutdown can't race Start
+
+	ready atomic.Bool // set by MarkReady once schema setup is done
+
+	// for GET /admin/runtime, the counters are kept up to date by logRequests
+	startedAt      time.Time
+	totalRequests  atomic.Int64
+	activeRequests atomic.Int64
+	breaker        interface{ BreakerState() string }             // the store's circuit breaker, nil without one
+	cache          interface{ CacheStats() (hits, misses int64) } // the account cache, nil without one
+
+	healthChecks []namedHealthCheck // for GET /health/detailed, see RegisterHealthCheck
+
+	accountLocks *keyedLocks // serializes money operations per account within this instance
 }
 
 // NewAPIServer creates a new APIServer instance with the specified listen address.
 // FACTORY pattern
-func NewAPIServer(listenAddr string, store AccountStore) *APIServer {
+func NewAPIServer(listenAddr string, store AccountStore, events *EventBus[AccountEvent], cfg *Config) *APIServer {
+	snakeCaseJSON = cfg.SnakeCaseJSON
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		listenAddr:   listenAddr,
+		store:        store,
+		events:       events,
+		cfg:          cfg,
+		httpServer:   &http.Server{Addr: listenAddr},
+		accountLocks: newKeyedLocks(),
+		startedAt:    time.Now().UTC(),
 	}
 }
 
-func (s *APIServer) Start() {
-	router := http.NewServeMux()
+// apiVersion is the prefix every current route is mounted under (ex. /v1/account)
+const apiVersion = "v1"
+
+// unversionedSunset is when the old unversioned /account alias stops being served
+var unversionedSunset = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// balanceSunset is when GET /account/{id}/balance can start answering 410, see handleGetBalance
+var balanceSunset = time.Date(2027, time.July, 1, 0, 0, 0, 0, time.UTC)
+
+// Start serves until the listener fails or Shutdown is called (then it returns http.ErrServerClosed).
+// it can run before the schema is set up: /ready answers right away and the API returns 503 until MarkReady is called
+func (s *APIServer) Start() error {
+	slog.Info("JSON API server running", "addr", s.listenAddr)
+
+	auth := func(next http.Handler) http.Handler {
+		return basicAuth(s.cfg.BasicAuthUser, s.cfg.BasicAuthPass, next)
+	}
+
+	// probes and /version are open, everything else needs basic auth. /admin/runtime and /health/detailed
+	// answer during schema setup too, the rest waits for MarkReady
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/version", s.handleVersion)
+	mux.Handle("/health/detailed", Chain(makeHTTPHandleFunc(s.handleHealthDetailed), auth))
+	mux.Handle("/admin/runtime", Chain(makeHTTPHandleFunc(s.handleRuntime), auth))
+	mux.Handle("/admin/activity", Chain(makeHTTPHandleFunc(s.handleActivity), auth, s.requireReady))
+	// CORS goes first so preflights are answered before auth turns them away. PUBLIC_ROUTES skip auth
+	mux.Handle("/", Chain(s.routes(), s.cors, perRoute(s.cfg.PublicRoutes, auth), s.requireReady, s.limitConcurrency, logBodies))
 
-	router.HandleFunc("/account/", makeHTTPHandleFunc(s.handleAccountRouter))
-	router.HandleFunc("/account", makeHTTPHandleFunc(s.handleAccountRouter))
+	s.httpServer.Handler = Chain(mux, s.logRequests)
+	return s.httpServer.ListenAndServe()
+}
+
+// routes registers every route on a new router
+func (s *APIServer) routes() http.Handler {
+	router := http.NewServeMux()
 
-	fmt.Println("JSON API server running on port: ", s.listenAddr)
+	// current routes
+	router.HandleFunc("/"+apiVersion+"/account/", makeHTTPHandleFunc(s.handleAccountRouter))
+	router.HandleFunc("/"+apiVersion+"/account", makeHTTPHandleFunc(s.handleAccountRouter))
 
-	http.ListenAndServe(s.listenAddr, router)
+	// unversioned alias kept during the deprecation window
+	router.HandleFunc("/account/", deprecated(makeHTTPHandleFunc(s.handleAccountRouter)))
+	router.HandleFunc("/account", deprecated(makeHTTPHandleFunc(s.handleAccountRouter)))
 
+	return router
 }
 
 // handleAccountRouter manually creates a router since we want to try without using chi/gin
 func (s *APIServer) handleAccountRouter(w http.ResponseWriter, req *http.Request) error {
-	path := strings.TrimPrefix(req.URL.Path, "/account") // removes the "/account" from the path
-	path = strings.Trim(path, "/")                       // removes leading/trailing slashes
+	path := strings.TrimPrefix(req.URL.Path, "/"+apiVersion) // removes the version prefix if the request used one
+	path = strings.TrimPrefix(path, "/account")              // removes the "/account" from the path
+	path = strings.Trim(path, "/")                           // removes leading/trailing slashes
 
-	segments := strings.Split(path, "/") // splits into different segments (ex. /account/1/balance => ["1", "balance"]
+	// splits into different segments (ex. /account/1/balance => ["1", "balance"]
+	// strings.Split("", "/") gives [""] so the base path has to be special cased to get zero segments
+	var segments []string
+	if path != "" {
+		segments = strings.Split(path, "/")
+	}
 
 	switch len(segments) {
 	case 0:
 		// /account (base path)
-		if req.Method == "POST" {
-			return s.handleCreateAccount(w, req)
-		}
-		return fmt.Errorf("method %s not allowed on /account", req.Method)
+		return methods{
+			http.MethodGet:  func() error { return s.handleListAccounts(w, req) },
+			http.MethodPost: func() error { return s.handleCreateAccount(w, req) },
+		}.serve(w, req)
 
 	case 1:
+		// /account/report
+		if segments[0] == "report" {
+			return methods{
+				http.MethodGet: func() error { return s.handleGetReport(w, req) },
+			}.serve(w, req)
+		}
+
+		// /account/balances
+		if segments[0] == "balances" {
+			return methods{
+				http.MethodPost: func() error { return s.handleGetBalances(w, req) },
+			}.serve(w, req)
+		}
+
+		// /account/search
+		if segments[0] == "search" {
+			return methods{
+				http.MethodGet: func() error { return s.handleSearchAccounts(w, req) },
+			}.serve(w, req)
+		}
+
 		// /account/{id}
-		id, err := strconv.Atoi(segments[0])
+		id, err := parseAccountID(segments[0])
 		if err != nil {
-			return fmt.Errorf("invalid account ID: %v", err)
+			return err
 		}
 
-		switch req.Method {
-		case "GET":
-			return s.handleGetAccount(w, req, id)
-		case "PUT":
-			return s.handleUpdateAccount(w, req, id)
-		case "DELETE":
-			return s.handleDeleteAccount(w, req, id)
-		default:
-			return fmt.Errorf("method %s not allowed on /account/{id}", req.Method)
-		}
+		return methods{
+			http.MethodGet:    func() error { return s.handleGetAccount(w, req, id) },
+			http.MethodPut:    func() error { return s.handleUpdateAccount(w, req, id) },
+			http.MethodPatch:  func() error { return s.handlePatchAccount(w, req, id) },
+			http.MethodDelete: func() error { return s.handleDeleteAccount(w, req, id) },
+		}.serve(w, req)
 
 	case 2:
 		// /account/{id}/{action} like /account/1/balance
-		id, err := strconv.Atoi(segments[0])
+		id, err := parseAccountID(segments[0])
 		if err != nil {
-			return fmt.Errorf("invalid account ID: %v", err)
+			return err
 		}
 
-		action := segments[1]
-		switch action {
+		switch segments[1] {
 		case "balance":
-			if req.Method == "GET" {
-				return s.handleGetBalance(w, req, id)
-			}
+			return methods{
+				http.MethodGet: func() error { return s.handleGetBalance(w, req, id) },
+			}.serve(w, req)
+		case "transfer-batch":
+			return methods{
+				http.MethodPost: func() error { return s.handleTransferBatch(w, req, id) },
+			}.serve(w, req)
+		case "audit":
+			return methods{
+				http.MethodGet: func() error { return s.handleGetAuditLog(w, req, id) },
+			}.serve(w, req)
+		case "statement", "statement.pdf":
+			return methods{
+				http.MethodGet: func() error { return s.handleGetStatement(w, req, id, segments[1] == "statement.pdf") },
+			}.serve(w, req)
 		}
 	}
 
-	return fmt.Errorf("not found")
+	return newStatusError(http.StatusNotFound, "not found")
+}
+
+// parseAccountID parses the {id} path segment. ids are Postgres INTs, so anything past MaxInt32 can't
+// exist and gets the same out of range message as a number too big to parse at all
+func parseAccountID(segment string) (int, error) {
+	id, err := strconv.Atoi(segment)
+	if errors.Is(err, strconv.ErrRange) || (err == nil && (id > math.MaxInt32 || id < math.MinInt32)) {
+		return 0, newCodedError(http.StatusBadRequest, CodeOutOfRange, "account ID %s is out of range, the maximum is %d", segment, math.MaxInt32)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid account ID %q: must be a whole number", segment)
+	}
+	return id, nil
+}
+
+func (s *APIServer) handleListAccounts(w http.ResponseWriter, req *http.Request) error {
+	limit, offset, err := s.parsePagination(w, req)
+	if err != nil {
+		return err
+	}
+
+	filter, err := parseAccountFilter(req)
+	if err != nil {
+		return err
+	}
+
+	accounts, total, err := s.store.ListAccounts(req.Context(), filter, limit, offset)
+	if err != nil {
+		return err
+	}
+
+	resp := make([]AccountResponse, 0, len(accounts))
+	for i := range accounts {
+		r := toAccountResponse(&accounts[i])
+		s.forClient(req, &r)
+		resp = append(resp, r)
+	}
+
+	meta := PageMeta{Total: total, Limit: limit, Offset: offset}
+	setPaginationLinks(w, req, meta)
+	return WriteJSON(w, http.StatusOK, AccountListResponse{Data: resp, Meta: meta})
 }
 
 func (s *APIServer) handleGetAccount(w http.ResponseWriter, req *http.Request, id int) error {
 
-	account, err := s.store.GetAccountByID(id)
+	account, err := s.store.GetAccountByID(req.Context(), id)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, account)
+	resp := toAccountResponse(account)
+	s.forClient(req, &resp)
+	if wantsDisplayFormat(req) {
+		resp.BalanceDisplay = FormatAmount(account.Balance, account.Currency)
+	}
+
+	return WriteJSON(w, http.StatusOK, resp)
 }
 
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, req *http.Request) error {
-	var createReq CreateAccountRequest
-	if err := json.NewDecoder(req.Body).Decode(&createReq); err != nil {
-		log.Printf("failed to decode request body: %v", err)
-		return fmt.Errorf("invalid request body")
+	createReq, err := decodeAndValidate[CreateAccountRequest](req)
+	if err != nil {
+		return err
 	}
 
-	created, err := s.store.CreateAccount(&createReq)
+	createReq.Currency = strings.ToUpper(strings.TrimSpace(createReq.Currency))
+	if createReq.Currency == "" {
+		createReq.Currency = defaultCurrency
+	}
+	if !isSupportedCurrency(createReq.Currency) {
+		return newCodedError(http.StatusBadRequest, CodeUnsupportedCurrency, "unsupported currency %q", createReq.Currency)
+	}
+
+	var created *Account
+	var changes []BalanceChange
+	if createReq.Funding != nil {
+		created, changes, err = s.createFundedAccount(req.Context(), createReq, actorFrom(req))
+	} else {
+		created, err = s.store.CreateAccount(req.Context(), createReq, actorFrom(req))
+	}
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusCreated, created)
+	resp := toAccountResponse(created)
+	s.events.Publish(AccountEvent{Type: EventAccountCreated, AccountID: created.ID, At: time.Now().UTC(), Data: resp})
+	s.publishBalanceChanges(changes)
+
+	s.forClient(req, &resp)
+
+	return WriteJSON(w, http.StatusCreated, resp)
+}
+
+// createFundedAccount creates the account and makes its opening transfer in one transaction, so a rejected
+// transfer doesn't leave an empty account behind. the balances it changed come back for the events
+func (s *APIServer) createFundedAccount(ctx context.Context, createReq *CreateAccountRequest, actor string) (*Account, []BalanceChange, error) {
+	beginner, ok := s.store.(TxBeginner)
+	if !ok {
+		return nil, nil, newStatusError(http.StatusNotImplemented, "funding a new account isn't supported by this store")
+	}
+	funding := createReq.Funding
+
+	// only the source needs the lock, nobody else knows the new account's id until we commit
+	unlock, err := s.accountLocks.Lock(ctx, funding.FromAccountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	tx, err := beginner.BeginTx(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	created, err := tx.CreateAccount(ctx, createReq, actor)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the amount is in the new account's currency. Convert has the batch convert it when the source holds
+	// another one (EXCHANGE_RATES), it changes nothing when they match
+	entry := TransferEntry{ToAccountID: created.ID, Amount: funding.Amount, Currency: createReq.Currency, Convert: true}
+	result, err := tx.TransferBatch(ctx, funding.FromAccountID, []TransferEntry{entry}, "", actor)
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.Status != "completed" {
+		code, msg := result.Results[0].Code, result.Results[0].Error
+		if msg == "" {
+			code, msg = result.Code, result.Error // batch level problem, ex. insufficient funds
+		}
+		status := http.StatusUnprocessableEntity
+		if code == CodeTransferLimitExceeded {
+			status = http.StatusConflict
+		}
+		return nil, nil, newCodedError(status, code, "funding from account %d: %s", funding.FromAccountID, msg)
+	}
+
+	// the account as it is after the transfer, read before the commit while the transaction still sees it
+	account, err := tx.GetAccountByID(ctx, created.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return account, result.Changes, nil
 }
 
+// confirmDeleteHeader set to true (or ?force=true) confirms deleting an account that still has money or history
+const confirmDeleteHeader = "X-Confirm-Delete"
+
 func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, req *http.Request, id int) error {
-	if err := s.store.DeleteAccount(id); err != nil {
+	force := req.Header.Get(confirmDeleteHeader) == "true" || req.URL.Query().Get("force") == "true"
+
+	unlock, err := s.accountLocks.Lock(req.Context(), id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.store.DeleteAccount(req.Context(), id, force, actorFrom(req)); err != nil {
+		if errors.Is(err, ErrDeleteNeedsConfirmation) {
+			return newCodedError(http.StatusConflict, CodeConfirmationRequired, "%v, send %s: true (or ?force=true) to delete it anyway",
+				err, confirmDeleteHeader)
+		}
 		return err
 	}
 
+	s.events.Publish(AccountEvent{Type: EventAccountDeleted, AccountID: id, At: time.Now().UTC()})
+
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
 func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, req *http.Request, id int) error {
-	var updateReq UpdateAccountRequest
-	if err := json.NewDecoder(req.Body).Decode(&updateReq); err != nil {
-		log.Printf("failed to decode request body: %v", err)
-		return fmt.Errorf("invalid request body")
+	updateReq, err := decodeAndValidate[UpdateAccountRequest](req)
+	if err != nil {
+		return err
+	}
+
+	// held across the read and the write below, so money operations from this instance can't slip in between
+	unlock, err := s.accountLocks.Lock(req.Context(), id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// only needed to tell whether the balance changed. it's only locked against this instance, so a write
+	// from another one can make us miss (or double up) a balance.changed event, which is fine for a notification.
+	// a missing account is a 404 here unless PUT is allowed to create it
+	previousBalance, err := s.store.GetAccountBalanceByID(req.Context(), id)
+	if err != nil && !(s.cfg.PutUpsert && errors.Is(err, ErrAccountNotFound)) {
+		return err
+	}
+
+	// the names don't matter here, only protected fields are compared. an account PUT creates starts at 0
+	if err := s.checkProtectedFields(req, UpdateAccountRequest{Balance: &previousBalance}, *updateReq); err != nil {
+		return err
+	}
+
+	var updated *Account
+	created := false
+	if s.cfg.PutUpsert {
+		updated, created, err = s.store.UpsertAccount(req.Context(), id, updateReq, actorFrom(req))
+	} else {
+		updated, err = s.store.UpdateAccount(req.Context(), id, updateReq, actorFrom(req))
+	}
+	if err != nil {
+		return err
+	}
+
+	resp := toAccountResponse(updated)
+	if created {
+		s.events.Publish(AccountEvent{Type: EventAccountCreated, AccountID: id, At: time.Now().UTC(), Data: resp})
+	} else {
+		s.publishAccountUpdated(resp, previousBalance)
+	}
+
+	s.forClient(req, &resp)
+	if created {
+		return WriteJSON(w, http.StatusCreated, resp)
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// mergePatchContentType is the only body type PATCH accepts, see RFC 7386
+const mergePatchContentType = "application/merge-patch+json"
+
+// handlePatchAccount applies a JSON Merge Patch to an account: only the keys present in the body change,
+// and null resets a field to its zero value. the merged account is validated like a PUT before it's written
+func (s *APIServer) handlePatchAccount(w http.ResponseWriter, req *http.Request, id int) error {
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != mergePatchContentType {
+		return newStatusError(http.StatusUnsupportedMediaType, "PATCH needs Content-Type %s", mergePatchContentType)
+	}
+
+	// decoded raw first so anything that isn't an object (arrays, null, ...) gets a clear message
+	body, err := decodeJSON[json.RawMessage](req)
+	if err != nil {
+		return err
+	}
+	var patch map[string]json.RawMessage
+	if (*body)[0] != '{' || json.Unmarshal(*body, &patch) != nil {
+		return newCodedError(http.StatusBadRequest, CodeInvalidJSON, "merge patch must be a JSON object")
+	}
+
+	unlock, err := s.accountLocks.Lock(req.Context(), id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := s.store.GetAccountByID(req.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	// start from the stored account, the patch only overrides what it mentions
+	balance := current.Balance
+	merged := UpdateAccountRequest{FirstName: current.FirstName, LastName: current.LastName, Balance: &balance}
+	targets := map[string]any{
+		"firstName": &merged.FirstName,
+		"lastName":  &merged.LastName,
+		"balance":   &balance, // not &merged.Balance, null resets the balance to 0 rather than leaving it as is
+	}
+	for _, key := range slices.Sorted(maps.Keys(patch)) { // sorted so the error for several bad keys is stable
+		target, ok := targets[key]
+		if !ok {
+			return newCodedError(http.StatusBadRequest, CodeUnknownField, "unknown field %q", key)
+		}
+		value := patch[key]
+		if string(value) == "null" {
+			reflect.ValueOf(target).Elem().SetZero()
+			continue
+		}
+		if err := json.Unmarshal(value, target); err != nil {
+			return newCodedError(http.StatusBadRequest, CodeInvalidJSON, "invalid value for field %q", key)
+		}
 	}
 
-	updated, err := s.store.UpdateAccount(id, &updateReq)
+	if err := validateRequest(&merged); err != nil {
+		return err
+	}
+	currentBalance := current.Balance
+	if err := s.checkProtectedFields(req, UpdateAccountRequest{Balance: &currentBalance}, merged); err != nil {
+		return err
+	}
+
+	// the account lock keeps other requests to this instance out between the read and the write. one from
+	// another instance can still land in between and be overwritten for the fields this patch didn't mention,
+	// same as two PUTs racing
+	updated, err := s.store.UpdateAccount(req.Context(), id, &merged, actorFrom(req))
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, updated)
+	resp := toAccountResponse(updated)
+	s.publishAccountUpdated(resp, current.Balance)
+
+	s.forClient(req, &resp)
+	return WriteJSON(w, http.StatusOK, resp)
 }
 
+// publishAccountUpdated publishes account.updated, plus balance.changed if the balance moved
+func (s *APIServer) publishAccountUpdated(resp AccountResponse, previousBalance int64) {
+	now := time.Now().UTC()
+	s.events.Publish(AccountEvent{Type: EventAccountUpdated, AccountID: resp.ID, At: now, Data: resp})
+	if resp.Balance != previousBalance {
+		s.events.Publish(AccountEvent{
+			Type:      EventBalanceChanged,
+			AccountID: resp.ID,
+			At:        now,
+			Data:      BalanceChangedData{PreviousBalance: previousBalance, Balance: resp.Balance},
+		})
+	}
+}
+
+// handleGetBalance is deprecated, GET /account/{id} already has the balance. it keeps working until
+// balanceSunset, after which it answers 410 Gone if BALANCE_ENDPOINT_GONE is set
 func (s *APIServer) handleGetBalance(w http.ResponseWriter, req *http.Request, id int) error {
-	balance, err := s.store.GetAccountBalanceByID(id)
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Sunset", balanceSunset.Format(http.TimeFormat))
+	// Add, the unversioned alias may have set its own successor link already
+	w.Header().Add("Link", fmt.Sprintf("</%s/account/%d>; rel=\"successor-version\"", apiVersion, id))
+
+	if s.cfg.BalanceEndpointGone && time.Now().After(balanceSunset) {
+		return newStatusError(http.StatusGone, "this endpoint was removed on %s, use GET /%s/account/%d",
+			balanceSunset.Format(time.DateOnly), apiVersion, id)
+	}
+
+	asOf, err := queryTime(req, "asOf")
+	if err != nil {
+		return err
+	}
+	if asOf != nil {
+		return s.handleGetBalanceAsOf(w, req, id, asOf.UTC())
+	}
+
+	if wantsDisplayFormat(req) {
+		// the formatted amount needs the account's currency, so fetch the whole account
+		account, err := s.store.GetAccountByID(req.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		resp := BalanceResponse{
+			ID:             id,
+			Balance:        account.Balance,
+			Currency:       account.Currency,
+			BalanceDisplay: FormatAmount(account.Balance, account.Currency),
+			stringNumbers:  s.wantsStringNumbers(req),
+		}
+		return WriteJSON(w, http.StatusOK, resp)
+	}
+
+	balance, err := s.store.GetAccountBalanceByID(req.Context(), id)
 	if err != nil {
 		return err
 	}
 
 	resp := BalanceResponse{
-		ID:      id,
-		Balance: balance,
+		ID:            id,
+		Balance:       balance,
+		stringNumbers: s.wantsStringNumbers(req),
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleGetBalanceAsOf answers GET /account/{id}/balance?asOf=, the balance the account had at that time.
+// asOf takes the same formats as the list filters. a time before the account existed is a 422
+func (s *APIServer) handleGetBalanceAsOf(w http.ResponseWriter, req *http.Request, id int, t time.Time) error {
+	balance, err := s.store.BalanceAsOf(req.Context(), id, t)
+	if errors.Is(err, ErrNoBalanceHistory) {
+		return &statusError{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Msg: err.Error(),
+			Fields: map[string]string{"asOf": "is before the account's balance history starts"}}
+	}
+	if err != nil {
+		return err
+	}
+
+	resp := BalanceResponse{ID: id, Balance: balance, AsOf: &t, stringNumbers: s.wantsStringNumbers(req)}
+	if wantsDisplayFormat(req) {
+		account, err := s.store.GetAccountByID(req.Context(), id)
+		if err != nil {
+			return err
+		}
+		resp.Currency = account.Currency
+		resp.BalanceDisplay = FormatAmount(balance, account.Currency)
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleGetBalances returns the balances of up to 100 accounts in one go, so a portfolio view doesn't need a
+// request per account. ids that don't exist aren't an error, they're listed under "missing"
+func (s *APIServer) handleGetBalances(w http.ResponseWriter, req *http.Request) error {
+	balancesReq, err := decodeAndValidate[BalancesRequest](req)
+	if err != nil {
+		return err
+	}
+
+	// asking for the same id twice gets it once
+	ids := make([]int, 0, len(balancesReq.IDs))
+	seen := make(map[int]bool, len(balancesReq.IDs))
+	for _, id := range balancesReq.IDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	balances, err := s.store.GetBalancesByIDs(req.Context(), ids)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[int]BalanceResponse, len(balances))
+	for _, b := range balances {
+		byID[b.ID] = b
+	}
+
+	resp := BalancesResponse{Data: []BalanceResponse{}, Missing: []int{}}
+	for _, id := range ids {
+		b, ok := byID[id]
+		if !ok {
+			resp.Missing = append(resp.Missing, id)
+			continue
+		}
+		b.stringNumbers = s.wantsStringNumbers(req)
+		resp.Data = append(resp.Data, b)
 	}
 	return WriteJSON(w, http.StatusOK, resp)
 }
 
+// maxTransferBatchSize caps how many entries a single batch transfer can hold (and so how many rows it locks)
+const maxTransferBatchSize = 500
+
+// transfer batch modes, picked with ?mode=
+const (
+	transferModeAtomic     = "atomic"      // default, all entries in one transaction, all or nothing
+	transferModeBestEffort = "best-effort" // each entry in its own transaction, failures don't undo the others
+)
+
+// handleTransferBatch pays many accounts from account id.
+// the body is a JSON array of {"toAccountID": 2, "amount": 100} entries. ?reference= makes a retry safe: a batch
+// with a reference that already completed answers with that batch's result instead of running again
+func (s *APIServer) handleTransferBatch(w http.ResponseWriter, req *http.Request, id int) error {
+	mode := queryString(req, "mode", transferModeAtomic)
+	if mode != transferModeAtomic && mode != transferModeBestEffort {
+		return fmt.Errorf("invalid mode %q, expected %s or %s", mode, transferModeAtomic, transferModeBestEffort)
+	}
+
+	reference := strings.TrimSpace(req.URL.Query().Get("reference"))
+	if len(reference) > maxReferenceLength {
+		return fmt.Errorf("reference must be at most %d characters, got %d", maxReferenceLength, len(reference))
+	}
+	if reference != "" && mode == transferModeBestEffort {
+		// one result per reference, a best-effort batch is a transaction per entry
+		return fmt.Errorf("reference only works with mode=%s", transferModeAtomic)
+	}
+
+	body, err := decodeJSON[[]TransferEntry](req)
+	if err != nil {
+		return err
+	}
+	entries := *body
+
+	if len(entries) == 0 {
+		return fmt.Errorf("transfer batch must have at least one entry")
+	}
+	if len(entries) > maxTransferBatchSize {
+		return fmt.Errorf("transfer batch has %d entries, the maximum is %d", len(entries), maxTransferBatchSize)
+	}
+
+	for i := range entries {
+		entries[i].Currency = strings.ToUpper(strings.TrimSpace(entries[i].Currency))
+		if c := entries[i].Currency; c != "" && !isSupportedCurrency(c) {
+			return newCodedError(http.StatusBadRequest, CodeUnsupportedCurrency, "entry %d: unsupported currency %q", i, c)
+		}
+	}
+
+	if mode == transferModeBestEffort {
+		result := s.transferBestEffort(req.Context(), id, entries, actorFrom(req))
+		s.publishBalanceChanges(result.Changes)
+
+		status := http.StatusOK
+		if result.Succeeded == 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		return WriteJSON(w, status, result)
+	}
+
+	// cheap checks that don't need the DB, done here so bad batches fail before any rows get locked
+	for i, e := range entries {
+		if err := checkTransferEntry(id, e); err != nil {
+			return newCodedError(http.StatusBadRequest, errorCode(err), "entry %d: %v", i, err)
+		}
+	}
+
+	// every account in the batch, the store locks the same rows again in the database
+	ids := []int{id}
+	for _, e := range entries {
+		ids = append(ids, e.ToAccountID)
+	}
+	unlock, err := s.accountLocks.Lock(req.Context(), ids...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	result, err := s.store.TransferBatch(req.Context(), id, entries, reference, actorFrom(req))
+	if err != nil {
+		return err
+	}
+	result.Mode = transferModeAtomic
+
+	if result.Status != "completed" {
+		status := http.StatusUnprocessableEntity
+		if result.Code == CodeTransferLimitExceeded {
+			status = http.StatusConflict
+		}
+		return WriteJSON(w, status, result)
+	}
+
+	s.publishBalanceChanges(result.Changes)
+	return WriteJSON(w, http.StatusOK, result)
+}
+
+// checkTransferEntry validates the parts of an entry that don't need the DB
+func checkTransferEntry(fromID int, e TransferEntry) error {
+	if e.ToAccountID == fromID {
+		return newCodedError(http.StatusBadRequest, CodeSelfTransfer, "cannot transfer from account %d to itself", fromID)
+	}
+	if e.Amount <= 0 {
+		return newCodedError(http.StatusBadRequest, CodeInvalidAmount, "amount must be positive, got %d", e.Amount)
+	}
+	return nil
+}
+
+// transferLocked runs a single entry transfer holding the account locks of both sides
+func (s *APIServer) transferLocked(ctx context.Context, fromID int, e TransferEntry, actor string) (*TransferBatchResult, error) {
+	unlock, err := s.accountLocks.Lock(ctx, fromID, e.ToAccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return s.store.TransferBatch(ctx, fromID, []TransferEntry{e}, "", actor)
+}
+
+// transferBestEffort runs every entry as its own single entry batch (so its own transaction). Entries that fail
+// are reported with their reason and don't roll back the ones that went through
+func (s *APIServer) transferBestEffort(ctx context.Context, fromID int, entries []TransferEntry, actor string) *TransferBatchResult {
+	result := &TransferBatchResult{
+		FromAccountID: fromID,
+		Mode:          transferModeBestEffort,
+		Results:       make([]TransferResult, len(entries)),
+	}
+
+	for i, e := range entries {
+		res := TransferResult{Index: i, ToAccountID: e.ToAccountID, Amount: e.Amount, Status: "ok"}
+
+		if err := checkTransferEntry(fromID, e); err != nil {
+			res.Status, res.Code, res.Error = "failed", errorCode(err), err.Error()
+		} else {
+			single, err := s.transferLocked(ctx, fromID, e, actor)
+			switch {
+			case err != nil:
+				res.Status, res.Code, res.Error = "failed", errorCode(err), err.Error()
+			case single.Status != "completed":
+				res.Status, res.Code, res.Error = "failed", single.Results[0].Code, single.Results[0].Error
+				if res.Error == "" {
+					res.Code, res.Error = single.Code, single.Error // batch level problem, ex. insufficient funds
+				}
+				result.Balance = single.Balance
+			default:
+				result.TotalAmount += single.TotalAmount // what left the source, converted if the entry needed it
+				result.Balance = single.Balance
+				result.Changes = append(result.Changes, single.Changes...)
+			}
+		}
+
+		if res.Status == "ok" {
+			result.Succeeded++
+		} else {
+			result.Failed++
+		}
+		result.Results[i] = res
+	}
+
+	switch {
+	case result.Failed == 0:
+		result.Status = "completed"
+	case result.Succeeded == 0:
+		result.Status = "failed"
+	default:
+		result.Status = "partial"
+	}
+	return result
+}
+
+// publishBalanceChanges publishes a balance.changed event for every change a transfer made
+func (s *APIServer) publishBalanceChanges(changes []BalanceChange) {
+	now := time.Now().UTC()
+	for _, c := range changes {
+		s.events.Publish(AccountEvent{
+			Type:      EventBalanceChanged,
+			AccountID: c.AccountID,
+			At:        now,
+			Data:      BalanceChangedData{PreviousBalance: c.Previous, Balance: c.Current},
+		})
+	}
+}
+
+// handleGetAuditLog returns the audit history of an account (admin only)
+func (s *APIServer) handleGetAuditLog(w http.ResponseWriter, req *http.Request, id int) error {
+	if err := s.requireAdmin(req); err != nil {
+		return err
+	}
+
+	entries, err := s.store.GetAuditLog(req.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, entries)
+}
+
+// handleGetReport aggregates balances with ?groupBy=lastName (default) and optionally sorts with ?order=count|total
+func (s *APIServer) handleGetReport(w http.ResponseWriter, req *http.Request) error {
+	groupBy := queryString(req, "groupBy", "lastName")
+
+	groups, err := s.store.GroupedBalances(req.Context(), groupBy)
+	if err != nil {
+		return err
+	}
+
+	// the store returns groups ordered by name, re-sort here if asked (largest first)
+	switch order := req.URL.Query().Get("order"); order {
+	case "":
+	case "count":
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].Count > groups[j].Count })
+	case "total":
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].TotalBalance > groups[j].TotalBalance })
+	default:
+		return fmt.Errorf("invalid order %q, expected count or total", order)
+	}
+
+	return WriteJSON(w, http.StatusOK, groups)
+}
+
+// wantsDisplayFormat checks for ?format=display, which adds pre-formatted money strings to the response
+func wantsDisplayFormat(req *http.Request) bool {
+	return req.URL.Query().Get("format") == "display"
+}
+
+// wantsStringNumbers reports whether number/balance should be sent as JSON strings. It's on for everyone with
+// JSON_STRING_NUMBERS=true, or per request with an Accept header like "application/json; numbers=string"
+func (s *APIServer) wantsStringNumbers(req *http.Request) bool {
+	return s.cfg.StringNumbers || acceptsJSONWith(req, "numbers", "string")
+}
+
+// wantsLinks reports whether account responses should carry _links. It's on for everyone with
+// RESPONSE_LINKS=true, or per request with an Accept header like "application/json; profile=links"
+func (s *APIServer) wantsLinks(req *http.Request) bool {
+	return s.cfg.ResponseLinks || acceptsJSONWith(req, "profile", "links")
+}
+
+// acceptsJSONWith reports whether the Accept header lists JSON with the media type parameter name=value
+func acceptsJSONWith(req *http.Request, name, value string) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if (mediaType == "application/json" || mediaType == "*/*") && params[name] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// forClient applies the per-client output options (string numbers, number masking, links) to an account response.
+// call it after publishing events, those shouldn't depend on who made the request
+func (s *APIServer) forClient(req *http.Request, resp *AccountResponse) {
+	resp.stringNumbers = s.wantsStringNumbers(req)
+	// with MASK_ACCOUNT_NUMBERS only requests carrying the admin token see full numbers
+	resp.maskNumber = s.cfg.MaskAccountNumbers && s.requireAdmin(req) != nil
+	if s.wantsLinks(req) {
+		resp.Links = accountLinks(req, resp.ID)
+	}
+}
+
+// accountLinks builds the _links for an account as absolute URLs on the host the request came in on.
+// they always point at the current versioned routes, even when the request used the deprecated alias
+func accountLinks(req *http.Request, id int) *AccountLinks {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	base := fmt.Sprintf("%s://%s/%s/account/%d", scheme, req.Host, apiVersion, id)
+
+	return &AccountLinks{
+		Self:         Link{Href: base},
+		Balance:      Link{Href: base + "/balance"},
+		Transfer:     Link{Href: base + "/transfer-batch"},
+		Audit:        Link{Href: base + "/audit"},
+		Transactions: Link{Href: base + "/statement"},
+	}
+}
+
+// JSONOptions changes how WriteJSONWithOptions encodes a response
+type JSONOptions struct {
+	Pretty bool // two-space indentation instead of compact output
+}
+
+// prettyResponseWriter marks a response for pretty-printing (?pretty=true or X-Pretty: true). makeHTTPHandleFunc
+// wraps the writer in it, so WriteJSON picks it up without every handler having to pass the request along
+type prettyResponseWriter struct {
+	http.ResponseWriter
+}
+
+// wantsPretty reports whether the request asked for indented JSON, anything but a true value means no
+func wantsPretty(req *http.Request) bool {
+	pretty, _ := strconv.ParseBool(req.URL.Query().Get("pretty"))
+	header, _ := strconv.ParseBool(req.Header.Get("X-Pretty"))
+	return pretty || header
+}
+
 // WriteJSON is a helper function that writes a JSON response with the given status code and data.
-// It sets the Content-Type to "application/json" and uses json.Encoder to write the response body.
+// the response is pretty-printed when the request asked for it (see prettyResponseWriter)
 func WriteJSON(w http.ResponseWriter, status int, data any) error {
+	_, pretty := w.(prettyResponseWriter)
+	return WriteJSONWithOptions(w, status, data, JSONOptions{Pretty: pretty})
+}
+
+// WriteJSONWithOptions writes data as a JSON response encoded as opts says.
+// It encodes into a buffer first so it can set Content-Length, and so an encoding error comes back
+// before anything has been written instead of leaving the client with half a body.
+func WriteJSONWithOptions(w http.ResponseWriter, status int, data any, opts JSONOptions) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(data); err != nil {
+		return err
+	}
+	if snakeCaseJSON {
+		renamed, err := renameKeys(buf.Bytes(), camelToSnake)
+		if err != nil {
+			return err
+		}
+		buf.Reset()
+		buf.Write(renamed) // still ends in Encode's newline
+	}
+	// indented last, so it also covers what renameKeys compacted
+	if opts.Pretty {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, buf.Bytes(), "", "  "); err != nil {
+			return err
+		}
+		buf = indented
+	}
+
 	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
 	w.WriteHeader(status)
-	return json.NewEncoder(w).Encode(data)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// deprecated wraps the handlers for the unversioned routes, telling clients (via the Deprecation/Sunset headers)
+// that they should move over to the /v1 routes before the sunset date
+func deprecated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", unversionedSunset.Format(http.TimeFormat))
+		w.Header().Set("Link", fmt.Sprintf("</%s%s>; rel=\"successor-version\"", apiVersion, req.URL.Path))
+		next(w, req)
+	}
 }
 
 // apiFunc is a custom function signature that wraps HTTP handlers but returns an error.
@@ -163,7 +973,76 @@ func WriteJSON(w http.ResponseWriter, status int, data any) error {
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
 type APIError struct {
-	Error string `json:"error"`
+	Code   ErrorCode         `json:"code"`             // stable, for programs
+	Error  string            `json:"error"`            // for humans
+	Fields map[string]string `json:"fields,omitempty"` // per-field messages when validation fails
+}
+
+// statusError is an error that carries the HTTP status it should be answered with.
+// handlers return these when the default 400 from makeHTTPHandleFunc isn't right
+type statusError struct {
+	Status int
+	Code   ErrorCode
+	Msg    string
+	Fields map[string]string // optional, per-field validation messages
+
+	RetryAfter time.Duration // sent as Retry-After when set, see newRetryableError
+}
+
+func (e *statusError) Error() string {
+	return e.Msg
+}
+
+// newStatusError builds a statusError with a fmt style message and the generic code for its status
+func newStatusError(status int, format string, args ...any) error {
+	return newCodedError(status, codeForStatus(status), format, args...)
+}
+
+// newCodedError is newStatusError with a more specific code
+func newCodedError(status int, code ErrorCode, format string, args ...any) error {
+	return &statusError{Status: status, Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// newRetryableError is newStatusError for a 429 or 503 the client should retry after a while,
+// makeHTTPHandleFunc answers it through writeRetryable
+func newRetryableError(status int, after time.Duration, format string, args ...any) error {
+	return &statusError{Status: status, Code: codeForStatus(status), Msg: fmt.Sprintf(format, args...), RetryAfter: after}
+}
+
+// retry delays clients are told to wait for
+const (
+	busyRetryAfter     = 1 * time.Second // MAX_CONCURRENT_REQUESTS is full, a slot frees up quickly
+	startupRetryAfter  = 5 * time.Second // schema setup is still running
+	databaseRetryAfter = 5 * time.Second // the database is down or the circuit breaker is open
+)
+
+// writeRetryable is how every 429 and 503 goes out: a Retry-After header in whole seconds (rounded up,
+// at least 1) and the usual APIError body, so clients can back off the same way whatever turned them away
+func writeRetryable(w http.ResponseWriter, status int, after time.Duration, apiErr APIError) error {
+	seconds := max(1, int64(math.Ceil(after.Seconds())))
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	return WriteJSON(w, status, apiErr)
+}
+
+// sentTracker remembers whether the status line has gone out, after that an error can't be answered anymore
+type sentTracker struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *sentTracker) WriteHeader(status int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sentTracker) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the real writer, ex. to flush a streamed response
+func (w *sentTracker) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 // makeHTTPHandleFunc takes an apiFunc and returns a standard http.HandlerFunc.
@@ -172,8 +1051,62 @@ type APIError struct {
 // btw this is the DECORATOR pattern
 func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			w = headResponseWriter{w} // handlers and error responses both skip the body
+		}
+		sent := &sentTracker{ResponseWriter: w}
+		w = sent
+		if wantsPretty(req) {
+			w = prettyResponseWriter{w} // outermost, so WriteJSON sees it
+		}
 		if err := f(w, req); err != nil {
-			WriteJSON(w, http.StatusBadRequest, APIError{Error: err.Error()})
+			// the client hung up, whatever failed failed because of that. there's nobody to answer, and it isn't
+			// our error, so it's only logged at debug level (logRequests records it as a 499)
+			if errors.Is(req.Context().Err(), context.Canceled) {
+				slog.Debug("request canceled by the client", "method", req.Method, "path", req.URL.Path, "error", err)
+				return
+			}
+
+			// the handler already sent its status (and maybe part of the body) before failing. an error response
+			// now would only be glued onto that, so the client gets a cut off response and we log what happened
+			if sent.wrote {
+				slog.Error("handler failed after the response was sent", "method", req.Method, "path", req.URL.Path, "error", err)
+				return
+			}
+
+			status := http.StatusBadRequest
+			apiErr := APIError{Code: errorCode(err), Error: err.Error()}
+			var retryAfter time.Duration
+
+			var statusErr *statusError
+			if errors.As(err, &statusErr) {
+				status = statusErr.Status
+				apiErr.Fields = statusErr.Fields
+				retryAfter = statusErr.RetryAfter
+			} else if errors.Is(err, ErrAccountNotFound) {
+				status = http.StatusNotFound
+			} else if errors.Is(err, ErrDuplicateName) || errors.Is(err, ErrReferenceInUse) {
+				status = http.StatusConflict
+			} else if errors.Is(err, ErrQueryTimeout) {
+				status = http.StatusGatewayTimeout
+			} else if errors.Is(err, ErrDatabaseUnavailable) {
+				status = http.StatusServiceUnavailable
+				retryAfter = databaseRetryAfter
+			} else if isConflictError(err) {
+				status = http.StatusConflict
+				apiErr.Error = "the account was changed by another request, please retry"
+			} else if isInternalError(err) {
+				// the details (SQL, table names, ...) are for us, not the client
+				slog.Error("internal error", "method", req.Method, "path", req.URL.Path, "error", err)
+				status = http.StatusInternalServerError
+				apiErr.Error = "internal server error"
+			}
+			localizeError(w, req, &apiErr)
+			if retryAfter > 0 || status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+				writeRetryable(w, status, retryAfter, apiErr)
+				return
+			}
+			WriteJSON(w, status, apiErr)
 		}
 	}
 }
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeleteMissingAccount(t *testing.T) {
+	h := newTestServer(newMemStore(), nil).routes()
+
+	rec := serve(h, http.MethodDelete, "/v1/account/7", "")
+	wantResponse(t, rec, http.StatusNotFound, `"code":"ACCOUNT_NOT_FOUND"`)
+}
+
+func TestDeleteExistingAccount(t *testing.T) {
+	h := newTestServer(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b"}), nil).routes()
+
+	wantResponse(t, serve(h, http.MethodDelete, "/v1/account/1", ""), http.StatusNoContent)
+	wantResponse(t, serve(h, http.MethodDelete, "/v1/account/1", ""), http.StatusNotFound)
+}
+
+// the account is deleted (by another instance, the in-process lock can't see it) between the handler's read
+// and its write. the update has to come back as a 404, not a 400 or a 500
+func TestUpdateLosesRaceWithDelete(t *testing.T) {
+	store := newMemStore(Account{ID: 1, FirstName: "a", LastName: "b"})
+	store.beforeUpdate = func(id int) {
+		store.mu.Lock()
+		delete(store.accs, id)
+		store.mu.Unlock()
+	}
+	h := newTestServer(store, nil).routes()
+
+	rec := serve(h, http.MethodPut, "/v1/account/1", `{"firstName":"x","lastName":"y"}`)
+	wantResponse(t, rec, http.StatusNotFound, `"code":"ACCOUNT_NOT_FOUND"`)
+}
+
+func TestConcurrentUpdateAndDelete(t *testing.T) {
+	for range 50 {
+		h := newTestServer(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b"}), nil).routes()
+
+		var wg sync.WaitGroup
+		var updateStatus, deleteStatus int
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			updateStatus = serve(h, http.MethodPut, "/v1/account/1", `{"firstName":"x","lastName":"y"}`).Code
+		}()
+		go func() {
+			defer wg.Done()
+			deleteStatus = serve(h, http.MethodDelete, "/v1/account/1", "").Code
+		}()
+		wg.Wait()
+
+		if updateStatus != http.StatusOK && updateStatus != http.StatusNotFound {
+			t.Fatalf("update status = %d, want 200 or 404", updateStatus)
+		}
+		if deleteStatus != http.StatusNoContent {
+			t.Fatalf("delete status = %d, want 204", deleteStatus)
+		}
+	}
+}
+
+func TestCreateFundedAccount(t *testing.T) {
+	store := NewCachedStore(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 1000, Currency: "USD"}), 10)
+	h := newTestServer(store, nil).routes()
+	wantResponse(t, serve(h, http.MethodGet, "/v1/account/1", ""), http.StatusOK, `"balance":1000`)
+
+	rec := serve(h, http.MethodPost, "/v1/account", `{"firstName":"c","lastName":"d","funding":{"fromAccountID":1,"amount":300}}`)
+	wantResponse(t, rec, http.StatusCreated, `"id":2`, `"balance":300`)
+
+	// the source was cached before the transfer, the commit has to drop it
+	wantResponse(t, serve(h, http.MethodGet, "/v1/account/1", ""), http.StatusOK, `"balance":700`)
+}
+
+// an account in another currency than its source is funded through a conversion, not rejected
+func TestCreateFundedAccountInAnotherCurrency(t *testing.T) {
+	store := newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 1000, Currency: "USD"})
+	h := newTestServer(store, nil).routes()
+
+	rec := serve(h, http.MethodPost, "/v1/account", `{"firstName":"c","lastName":"d","currency":"EUR","funding":{"fromAccountID":1,"amount":300}}`)
+	wantResponse(t, rec, http.StatusCreated, `"currency":"EUR"`, `"balance":300`)
+}
+
+func TestCreateFundedAccountRejected(t *testing.T) {
+	store := newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 100, Currency: "USD"})
+	h := newTestServer(store, nil).routes()
+
+	rec := serve(h, http.MethodPost, "/v1/account", `{"firstName":"c","lastName":"d","funding":{"fromAccountID":1,"amount":300}}`)
+	wantResponse(t, rec, http.StatusUnprocessableEntity, `"code":"INSUFFICIENT_FUNDS"`)
+
+	rec = serve(h, http.MethodPost, "/v1/account", `{"firstName":"c","lastName":"d","funding":{"fromAccountID":9,"amount":50}}`)
+	wantResponse(t, rec, http.StatusNotFound, `"code":"ACCOUNT_NOT_FOUND"`)
+
+	if len(store.accs) != 1 {
+		t.Fatalf("%d accounts after rejected funding, want the source only", len(store.accs))
+	}
+}
+
+func TestCreateFundedAccountNeedsTransactions(t *testing.T) {
+	store := struct{ AccountStore }{newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 1000})}
+	h := newTestServer(store, nil).routes()
+
+	rec := serve(h, http.MethodPost, "/v1/account", `{"firstName":"c","lastName":"d","funding":{"fromAccountID":1,"amount":300}}`)
+	wantResponse(t, rec, http.StatusNotImplemented)
+}
+
+// convertingStore debits the source twice the amount of every entry, like a conversion at a rate of 2
+type convertingStore struct {
+	*memStore
+}
+
+func (c convertingStore) TransferBatch(ctx context.Context, fromID int, entries []TransferEntry, reference, actor string) (*TransferBatchResult, error) {
+	result, err := c.memStore.TransferBatch(ctx, fromID, entries, reference, actor)
+	if err == nil && result.Status == "completed" {
+		result.TotalAmount *= 2
+	}
+	return result, err
+}
+
+func TestBestEffortTotalIsWhatTheSourceSent(t *testing.T) {
+	store := convertingStore{newMemStore(Account{ID: 1, Balance: 1000}, Account{ID: 2}, Account{ID: 3})}
+	h := newTestServer(store, nil).routes()
+
+	rec := serve(h, http.MethodPost, "/v1/account/1/transfer-batch?mode=best-effort",
+		`[{"toAccountID":2,"amount":10},{"toAccountID":3,"amount":20},{"toAccountID":9,"amount":30}]`)
+	wantResponse(t, rec, http.StatusOK, `"status":"partial"`, `"totalAmount":60`)
+}
+
+func TestParseAccountID(t *testing.T) {
+	tests := []struct {
+		segment string
+		want    int
+		code    ErrorCode
+	}{
+		{"1", 1, ""},
+		{"2147483647", 2147483647, ""},
+		{"2147483648", 0, CodeOutOfRange},
+		{"-2147483649", 0, CodeOutOfRange},
+		{"99999999999999999999", 0, CodeOutOfRange},
+		{"abc", 0, CodeBadRequest},
+		{"1.5", 0, CodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.segment, func(t *testing.T) {
+			got, err := parseAccountID(tt.segment)
+			checkQueryErr(t, err, tt.code)
+			if err == nil && got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	h := newTestServer(newMemStore(), nil).routes()
+	wantResponse(t, serve(h, http.MethodGet, "/v1/account/99999999999999999999", ""), http.StatusBadRequest,
+		`"code":"OUT_OF_RANGE"`, `the maximum is 2147483647`)
+}
+
+func TestWriteJSONContentLength(t *testing.T) {
+	for _, data := range []any{
+		map[string]string{"name": "José"}, // multi-byte, the length is in bytes
+		[]int{},
+		APIError{Code: CodeNotFound, Error: "not found"},
+	} {
+		rec := httptest.NewRecorder()
+		if err := WriteJSON(rec, http.StatusOK, data); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := rec.Header().Get("Content-Length"), strconv.Itoa(rec.Body.Len()); got != want {
+			t.Errorf("Content-Length = %s, body is %s bytes", got, want)
+		}
+	}
+
+	// an error response through makeHTTPHandleFunc, HEAD included (same length, no body)
+	h := newTestServer(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b"}), nil).routes()
+	get := serve(h, http.MethodGet, "/v1/account/1", "")
+	if got, want := get.Header().Get("Content-Length"), strconv.Itoa(get.Body.Len()); got != want {
+		t.Errorf("GET Content-Length = %s, body is %s bytes", got, want)
+	}
+	head := serve(h, http.MethodHead, "/v1/account/1", "")
+	if head.Header().Get("Content-Length") != get.Header().Get("Content-Length") || head.Body.Len() != 0 {
+		t.Errorf("HEAD Content-Length = %s with a %d byte body, want GET's %s and none",
+			head.Header().Get("Content-Length"), head.Body.Len(), get.Header().Get("Content-Length"))
+	}
+}
+
+func TestWriteJSONEncodingErrorWritesNothing(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if err := WriteJSON(rec, http.StatusOK, map[string]any{"bad": make(chan int)}); err == nil {
+		t.Fatal("encoding a channel didn't fail")
+	}
+	if rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "" {
+		t.Fatal("a failed encoding wrote part of a response")
+	}
+}
+
+func TestPrettyOutput(t *testing.T) {
+	h := newTestServer(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b"}), nil).routes()
+
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"?pretty=true":   serve(h, http.MethodGet, "/v1/account/1?pretty=true", ""),
+		"X-Pretty":       serve(h, http.MethodGet, "/v1/account/1", "", "X-Pretty", "true"),
+		"error response": serve(h, http.MethodGet, "/v1/account/9?pretty=1", ""),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var want bytes.Buffer
+			json.Indent(&want, rec.Body.Bytes(), "", "  ")
+			if !bytes.Contains(rec.Body.Bytes(), []byte("{\n  \"")) || rec.Body.String() != want.String() {
+				t.Fatalf("body isn't indented with two spaces:\n%s", rec.Body)
+			}
+			if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+				t.Fatalf("Content-Length = %s, body is %d bytes", rec.Header().Get("Content-Length"), rec.Body.Len())
+			}
+		})
+	}
+
+	for _, path := range []string{"/v1/account/1", "/v1/account/1?pretty=false", "/v1/account/1?pretty=nope"} {
+		if rec := serve(h, http.MethodGet, path, ""); bytes.Contains(rec.Body.Bytes(), []byte("\n  ")) {
+			t.Errorf("%s is indented:\n%s", path, rec.Body)
+		}
+	}
+}
+
+// the client hung up: nothing is written, there's nobody to read it, and the request is logged as a 499
+func TestClientCanceledRequest(t *testing.T) {
+	s := newTestServer(unreachableStore(t), nil)
+	h := s.logRequests(s.routes())
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/v1/account/1", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "" {
+		t.Fatalf("wrote a response to a canceled request: %s", rec.Body)
+	}
+	if !strings.Contains(logs.String(), "level=DEBUG msg=\"request canceled by the client\"") {
+		t.Errorf("cancel not logged at debug level:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "status=499") {
+		t.Errorf("request not logged as a 499:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "level=ERROR") {
+		t.Errorf("a canceled request was logged as an error:\n%s", logs.String())
+	}
+}
+
+// a handler that fails after it started its response: the error isn't glued onto it, it's logged instead
+func TestErrorAfterResponseSent(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	for name, handler := range map[string]apiFunc{
+		"status only": func(w http.ResponseWriter, _ *http.Request) error {
+			w.WriteHeader(http.StatusAccepted)
+			return fmt.Errorf("failed after the status")
+		},
+		"part of the body": func(w http.ResponseWriter, _ *http.Request) error {
+			w.Write([]byte(`{"data":[`))
+			return fmt.Errorf("failed mid body")
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			logs.Reset()
+			rec := httptest.NewRecorder()
+			makeHTTPHandleFunc(handler)(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if strings.Contains(rec.Body.String(), `"error"`) {
+				t.Fatalf("error response appended to the one already sent: %s", rec.Body)
+			}
+			if !strings.Contains(logs.String(), "handler failed after the response was sent") {
+				t.Fatalf("failure not logged:\n%s", logs.String())
+			}
+		})
+	}
+
+	// nothing sent yet, the error still gets its response
+	rec := httptest.NewRecorder()
+	makeHTTPHandleFunc(func(http.ResponseWriter, *http.Request) error {
+		return fmt.Errorf("failed early")
+	})(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	wantResponse(t, rec, http.StatusBadRequest, `"error":"failed early"`)
+}
+
+// downStore fails every GetAccountByID like the breaker does while it's open
+type downStore struct {
+	*memStore
+}
+
+func (downStore) GetAccountByID(context.Context, int) (*Account, error) {
+	return nil, ErrDatabaseUnavailable
+}
+
+func TestRetryAfter(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	t.Run("starting up", func(t *testing.T) {
+		s := newTestServer(newMemStore(), nil)
+		rec := serve(s.requireReady(ok), http.MethodGet, "/v1/account", "")
+		wantRetryAfter(t, rec, http.StatusServiceUnavailable, "5")
+		s.MarkReady()
+		wantResponse(t, serve(s.requireReady(ok), http.MethodGet, "/v1/account", ""), http.StatusOK)
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		s := newTestServer(newMemStore(), &Config{MaxConcurrentRequests: 1})
+		entered, release := make(chan struct{}), make(chan struct{})
+		h := s.limitConcurrency(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			close(entered)
+			<-release
+		}))
+		go serve(h, http.MethodGet, "/", "")
+		<-entered
+		defer close(release)
+
+		wantRetryAfter(t, serve(h, http.MethodGet, "/", ""), http.StatusServiceUnavailable, "1")
+	})
+
+	t.Run("database unavailable", func(t *testing.T) {
+		h := newTestServer(downStore{newMemStore()}, nil).routes()
+		wantRetryAfter(t, serve(h, http.MethodGet, "/v1/account/1", ""), http.StatusServiceUnavailable, "5")
+	})
+
+	t.Run("429 without a delay", func(t *testing.T) {
+		h := makeHTTPHandleFunc(func(http.ResponseWriter, *http.Request) error {
+			return newStatusError(http.StatusTooManyRequests, "slow down")
+		})
+		wantRetryAfter(t, serve(h, http.MethodGet, "/", ""), http.StatusTooManyRequests, "1")
+	})
+
+	t.Run("rounded up", func(t *testing.T) {
+		for after, want := range map[time.Duration]string{0: "1", time.Millisecond: "1", 1500 * time.Millisecond: "2", 3 * time.Second: "3"} {
+			rec := httptest.NewRecorder()
+			writeRetryable(rec, http.StatusServiceUnavailable, after, APIError{Code: CodeUnavailable})
+			if got := rec.Header().Get("Retry-After"); got != want {
+				t.Errorf("Retry-After for %v = %s, want %s", after, got, want)
+			}
+		}
+	})
+}
+
+// wantRetryAfter checks a retryable response: status, Retry-After and an APIError body with the status' code
+func wantRetryAfter(t *testing.T, rec *httptest.ResponseRecorder, status int, retryAfter string) {
+	t.Helper()
+	wantResponse(t, rec, status, `"code":"`+string(codeForStatus(status))+`"`)
+	if got := rec.Header().Get("Retry-After"); got != retryAfter {
+		t.Fatalf("Retry-After = %q, want %q", got, retryAfter)
+	}
+}
+
+func TestUpdateOmittedBalanceVsZero(t *testing.T) {
+	admin := []string{adminTokenHeader, "secret"}
+	tests := []struct {
+		name, method, body string
+		hdr                []string
+		want               int64
+	}{
+		{"PUT without balance", http.MethodPut, `{"firstName":"x","lastName":"y"}`, admin, 100},
+		{"PUT with balance 0", http.MethodPut, `{"firstName":"x","lastName":"y","balance":0}`, admin, 0},
+		{"PUT with balance null", http.MethodPut, `{"firstName":"x","lastName":"y","balance":null}`, admin, 100},
+		{"PATCH without balance", http.MethodPatch, `{"firstName":"x"}`, []string{"Content-Type", mergePatchContentType}, 100},
+		{"PATCH with balance 0", http.MethodPatch, `{"balance":0}`, append([]string{"Content-Type", mergePatchContentType}, admin...), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 100})
+			h := newTestServer(store, &Config{AdminToken: "secret"}).routes()
+
+			wantResponse(t, serve(h, tt.method, "/v1/account/1", tt.body, tt.hdr...), http.StatusOK)
+			if got := store.accs[1].Balance; got != tt.want {
+				t.Fatalf("balance = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPutMissingAccount(t *testing.T) {
+	body := `{"firstName":"x","lastName":"y"}`
+
+	t.Run("404 by default", func(t *testing.T) {
+		store := newMemStore()
+		h := newTestServer(store, nil).routes()
+		wantResponse(t, serve(h, http.MethodPut, "/v1/account/5", body), http.StatusNotFound, `"code":"ACCOUNT_NOT_FOUND"`)
+		if len(store.accs) != 0 {
+			t.Fatal("PUT created an account")
+		}
+	})
+
+	t.Run("created with PUT_UPSERT", func(t *testing.T) {
+		store := newMemStore()
+		h := newTestServer(store, &Config{PutUpsert: true}).routes()
+		wantResponse(t, serve(h, http.MethodPut, "/v1/account/5", body), http.StatusCreated, `"id":5`, `"firstName":"x"`)
+		// the same PUT again is an update of what's there now
+		wantResponse(t, serve(h, http.MethodPut, "/v1/account/5", body), http.StatusOK, `"id":5`)
+		if len(store.accs) != 1 {
+			t.Fatalf("%d accounts, want 1", len(store.accs))
+		}
+	})
+
+	t.Run("upsert can't start with a balance", func(t *testing.T) {
+		h := newTestServer(newMemStore(), &Config{PutUpsert: true}).routes()
+		rec := serve(h, http.MethodPut, "/v1/account/5", `{"firstName":"x","lastName":"y","balance":500}`)
+		wantResponse(t, rec, http.StatusForbidden, `"code":"FORBIDDEN"`)
+	})
+}
+
+func TestDeprecatedBalanceEndpoint(t *testing.T) {
+	store := newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 250})
+
+	rec := serve(newTestServer(store, nil).routes(), http.MethodGet, "/v1/account/1/balance", "")
+	wantResponse(t, rec, http.StatusOK, `"balance":250`)
+	if rec.Header().Get("Deprecation") != "true" || rec.Header().Get("Sunset") != balanceSunset.Format(http.TimeFormat) {
+		t.Fatalf("Deprecation %q, Sunset %q", rec.Header().Get("Deprecation"), rec.Header().Get("Sunset"))
+	}
+	if link := rec.Header().Get("Link"); !strings.Contains(link, `</v1/account/1>; rel="successor-version"`) {
+		t.Fatalf("Link = %q", link)
+	}
+
+	// before the sunset BALANCE_ENDPOINT_GONE changes nothing yet
+	gone := newTestServer(store, &Config{BalanceEndpointGone: true}).routes()
+	wantResponse(t, serve(gone, http.MethodGet, "/v1/account/1/balance", ""), http.StatusOK)
+
+	defer func(sunset time.Time) { balanceSunset = sunset }(balanceSunset)
+	balanceSunset = time.Now().Add(-time.Hour)
+
+	rec = serve(gone, http.MethodGet, "/v1/account/1/balance", "")
+	wantResponse(t, rec, http.StatusGone, `"code":"GONE"`, "use GET /v1/account/1")
+	if rec.Header().Get("Deprecation") != "true" {
+		t.Fatal("410 without the Deprecation header")
+	}
+	// past the sunset but without the flag it keeps working
+	wantResponse(t, serve(newTestServer(store, nil).routes(), http.MethodGet, "/v1/account/1/balance", ""), http.StatusOK)
+}
+
+func TestCheckTransferEntry(t *testing.T) {
+	tests := []struct {
+		entry TransferEntry
+		code  ErrorCode
+	}{
+		{TransferEntry{ToAccountID: 2, Amount: 1}, ""},
+		{TransferEntry{ToAccountID: 1, Amount: 10}, CodeSelfTransfer},
+		{TransferEntry{ToAccountID: 2, Amount: 0}, CodeInvalidAmount},
+		{TransferEntry{ToAccountID: 2, Amount: -5}, CodeInvalidAmount},
+		{TransferEntry{ToAccountID: 1, Amount: 0}, CodeSelfTransfer}, // the first problem wins
+	}
+	for _, tt := range tests {
+		checkQueryErr(t, checkTransferEntry(1, tt.entry), tt.code)
+	}
+}
+
+func TestTransferGuards(t *testing.T) {
+	tests := []struct {
+		name, mode, body string
+		status           int
+		want             string
+	}{
+		{"self transfer", "atomic", `[{"toAccountID":1,"amount":10}]`, http.StatusBadRequest, `"code":"SELF_TRANSFER"`},
+		{"zero amount", "atomic", `[{"toAccountID":2,"amount":0}]`, http.StatusBadRequest, `"code":"INVALID_AMOUNT"`},
+		{"negative amount", "atomic", `[{"toAccountID":2,"amount":-10}]`, http.StatusBadRequest, `"code":"INVALID_AMOUNT"`},
+		{"bad entry after a good one", "atomic", `[{"toAccountID":2,"amount":10},{"toAccountID":1,"amount":10}]`, http.StatusBadRequest, "entry 1"},
+		{"best-effort self transfer", "best-effort", `[{"toAccountID":1,"amount":10}]`, http.StatusUnprocessableEntity, `"code":"SELF_TRANSFER"`},
+		{"best-effort zero amount", "best-effort", `[{"toAccountID":2,"amount":0}]`, http.StatusUnprocessableEntity, `"code":"INVALID_AMOUNT"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore(Account{ID: 1, Balance: 100}, Account{ID: 2})
+			h := newTestServer(store, nil).routes()
+
+			wantResponse(t, serve(h, http.MethodPost, "/v1/account/1/transfer-batch?mode="+tt.mode, tt.body), tt.status, tt.want)
+			if store.accs[1].Balance != 100 || store.accs[2].Balance != 0 {
+				t.Fatal("a rejected transfer moved money")
+			}
+		})
+	}
+}
+
+// a retry with the same reference gets the first result back, the money only moves once
+func TestTransferReference(t *testing.T) {
+	store := newMemStore(Account{ID: 1, Balance: 100}, Account{ID: 2}, Account{ID: 3, Balance: 100})
+	h := newTestServer(store, nil).routes()
+	body := `[{"toAccountID":2,"amount":30}]`
+
+	rec := serve(h, http.MethodPost, "/v1/account/1/transfer-batch?reference=pay-42", body)
+	wantResponse(t, rec, http.StatusOK, `"reference":"pay-42"`, `"balance":70`)
+	if strings.Contains(rec.Body.String(), "replayed") {
+		t.Fatalf("first batch is marked replayed: %s", rec.Body)
+	}
+
+	rec = serve(h, http.MethodPost, "/v1/account/1/transfer-batch?reference=pay-42", body)
+	wantResponse(t, rec, http.StatusOK, `"reference":"pay-42"`, `"balance":70`, `"replayed":true`)
+	if store.accs[1].Balance != 70 || store.accs[2].Balance != 30 {
+		t.Fatalf("balances %d and %d, want 70 and 30", store.accs[1].Balance, store.accs[2].Balance)
+	}
+
+	rec = serve(h, http.MethodPost, "/v1/account/3/transfer-batch?reference=pay-42", body)
+	wantResponse(t, rec, http.StatusConflict, `"code":"REFERENCE_IN_USE"`)
+
+	// a rejected batch doesn't use up its reference
+	wantResponse(t, serve(h, http.MethodPost, "/v1/account/1/transfer-batch?reference=pay-43", `[{"toAccountID":2,"amount":500}]`),
+		http.StatusUnprocessableEntity, `"code":"INSUFFICIENT_FUNDS"`)
+	wantResponse(t, serve(h, http.MethodPost, "/v1/account/1/transfer-batch?reference=pay-43", body), http.StatusOK, `"balance":40`)
+
+	wantResponse(t, serve(h, http.MethodPost, "/v1/account/1/transfer-batch?mode=best-effort&reference=pay-44", body),
+		http.StatusBadRequest, "reference only works with mode=atomic")
+	wantResponse(t, serve(h, http.MethodPost, "/v1/account/1/transfer-batch?reference="+strings.Repeat("x", maxReferenceLength+1), body),
+		http.StatusBadRequest, "reference must be at most")
+}
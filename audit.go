@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// audit actions, one per kind of account mutation
+const (
+	AuditCreate   = "create"
+	AuditUpdate   = "update"
+	AuditDelete   = "delete"
+	AuditTransfer = "transfer"
+)
+
+// AuditEntry is one immutable row of the audit log
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	AccountID int             `json:"accountId"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	Before    json.RawMessage `json:"before"` // null for creates
+	After     json.RawMessage `json:"after"`  // null for deletes
+	At        time.Time       `json:"at"`
+}
+
+// createAuditLogTable creates the audit_log table plus a trigger that refuses any UPDATE or DELETE on it,
+// so rows can only ever be appended. account_id has no FK on purpose, the history has to outlive the account
+func (s *PostgresStore) createAuditLogTable() error {
+	table := `CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		account_id INT NOT NULL,
+		action VARCHAR(20) NOT NULL,
+		actor VARCHAR(100) NOT NULL,
+		before JSONB,
+		after JSONB,
+		at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`
+	index := `CREATE INDEX IF NOT EXISTS audit_log_account_id_idx ON audit_log (account_id, at);`
+	// for the activity feed, which pages through every account's entries newest first
+	atIndex := `CREATE INDEX IF NOT EXISTS audit_log_at_idx ON audit_log (at DESC, id DESC);`
+	fn := `
+	CREATE OR REPLACE FUNCTION audit_log_immutable()
+	RETURNS TRIGGER AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_log rows cannot be modified or deleted';
+	END;
+	$$ LANGUAGE plpgsql;
+	`
+	// drop + create in one transaction keeps this idempotent without relying on CREATE OR REPLACE TRIGGER (PG14+)
+	drop := `DROP TRIGGER IF EXISTS trigger_audit_log_immutable ON audit_log;`
+	create := `
+	CREATE TRIGGER trigger_audit_log_immutable
+	BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW
+	EXECUTE FUNCTION audit_log_immutable();
+	`
+
+	for _, query := range []string{table, index, atIndex, fn} {
+		if _, err := s.db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return s.execTx(drop, create)
+}
+
+// insertAudit appends an audit row inside tx, so it commits (or rolls back) together with the change it describes.
+// before/after are marshalled to JSON, nil is stored as NULL
+func insertAudit(ctx context.Context, tx querier, accountID int, action, actor string, before, after any) error {
+	beforeJSON, err := auditJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditJSON(after)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_log (account_id, action, actor, before, after)
+		VALUES ($1, $2, $3, $4, $5);
+	`
+	_, err = tx.ExecContext(ctx, query, accountID, action, actor, beforeJSON, afterJSON)
+	return err
+}
+
+func auditJSON(v any) (sql.NullString, error) {
+	if v == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// GetAuditLog returns the audit history of an account, newest first
+func (s *PostgresStore) GetAuditLog(ctx context.Context, accountID int) (_ []AuditEntry, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	query := `
+		SELECT id, account_id, action, actor, COALESCE(before, 'null'), COALESCE(after, 'null'), at
+		FROM audit_log
+		WHERE account_id = $1
+		ORDER BY at DESC, id DESC;
+	`
+
+	return s.queryAuditEntries(ctx, query, accountID)
+}
+
+// GetActivity returns up to limit audit entries across all accounts, newest first, starting after the given
+// cursor (nil starts at the newest). (at, id) orders entries with the same timestamp, so paging never skips one
+func (s *PostgresStore) GetActivity(ctx context.Context, after *ActivityCursor, limit int) (_ []AuditEntry, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	if after == nil {
+		query := `
+			SELECT id, account_id, action, actor, COALESCE(before, 'null'), COALESCE(after, 'null'), at
+			FROM audit_log
+			ORDER BY at DESC, id DESC
+			LIMIT $1;
+		`
+		return s.queryAuditEntries(ctx, query, limit)
+	}
+
+	query := `
+		SELECT id, account_id, action, actor, COALESCE(before, 'null'), COALESCE(after, 'null'), at
+		FROM audit_log
+		WHERE (at, id) < ($1, $2)
+		ORDER BY at DESC, id DESC
+		LIMIT $3;
+	`
+	return s.queryAuditEntries(ctx, query, after.At, after.ID, limit)
+}
+
+// queryAuditEntries runs a query selecting
+// "id, account_id, action, actor, COALESCE(before, 'null'), COALESCE(after, 'null'), at" and scans the entries
+func (s *PostgresStore) queryAuditEntries(ctx context.Context, query string, args ...any) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := s.withReadRetry(ctx, func() error {
+		rows, err := s.q().QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		entries = []AuditEntry{}
+		for rows.Next() {
+			var e AuditEntry
+			var before, after string
+			if err := rows.Scan(&e.ID, &e.AccountID, &e.Action, &e.Actor, &before, &after, &e.At); err != nil {
+				return err
+			}
+			e.Before, e.After = json.RawMessage(before), json.RawMessage(after)
+			e.At = e.At.UTC()
+			entries = append(entries, e)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
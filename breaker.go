@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// ErrDatabaseUnavailable is returned without touching the database while the circuit breaker is open,
+// the API turns it into a 503
+var ErrDatabaseUnavailable = errors.New("the database is unavailable")
+
+// BreakerStore is a decorator that puts a circuit breaker in front of every method of an AccountStore.
+// after DB_BREAKER_FAILURES consecutive connection errors or timeouts it opens and fails fast for
+// DB_BREAKER_COOLDOWN, then lets a single call through to see if the database is back.
+// only errors that say the database itself is in trouble count, a missing account or a bad transfer doesn't
+type BreakerStore struct {
+	store AccountStore
+	cb    *gobreaker.CircuitBreaker
+}
+
+// NewBreakerStore wraps store with a circuit breaker configured from the environment.
+// it returns nil (no breaker) when DB_BREAKER_FAILURES is 0
+func NewBreakerStore(store AccountStore) (*BreakerStore, error) {
+	failures := defaultBreakerFailures
+	if v := os.Getenv("DB_BREAKER_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid DB_BREAKER_FAILURES %q", v)
+		}
+		failures = n
+	}
+	if failures == 0 {
+		return nil, nil
+	}
+
+	cooldown := defaultBreakerCooldown
+	if v := os.Getenv("DB_BREAKER_COOLDOWN"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid DB_BREAKER_COOLDOWN %q", v)
+		}
+		cooldown = d
+	}
+
+	return &BreakerStore{
+		store: store,
+		cb: gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:        "postgres",
+			MaxRequests: 1, // half-open: one trial call decides whether we close again
+			Timeout:     cooldown,
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				return counts.ConsecutiveFailures >= uint32(failures)
+			},
+			IsSuccessful: func(err error) bool {
+				return err == nil || !isDatabaseFailure(err)
+			},
+			OnStateChange: func(name string, from, to gobreaker.State) {
+				slog.Warn("circuit breaker changed state", "breaker", name, "from", from.String(), "to", to.String())
+			},
+		}),
+	}, nil
+}
+
+// BreakerState returns "closed", "half-open" or "open"
+func (b *BreakerStore) BreakerState() string {
+	return b.cb.State().String()
+}
+
+// isDatabaseFailure reports whether err means the database is down or struggling, which is what trips the breaker.
+// a client hanging up mid-query says nothing about the database, so that never counts
+func isDatabaseFailure(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	return isTransientDBError(err) || errors.Is(err, ErrQueryTimeout)
+}
+
+// run calls op through the breaker. while the breaker is open (or its half-open trial is in flight)
+// op isn't called at all and ErrDatabaseUnavailable comes back instead
+func (b *BreakerStore) run(op func() error) error {
+	_, err := b.cb.Execute(func() (any, error) { return nil, op() })
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return fmt.Errorf("%w, try again shortly", ErrDatabaseUnavailable)
+	}
+	return err
+}
+
+func (b *BreakerStore) CreateAccount(ctx context.Context, req *CreateAccountRequest, actor string) (acc *Account, err error) {
+	err = b.run(func() error {
+		acc, err = b.store.CreateAccount(ctx, req, actor)
+		return err
+	})
+	return acc, err
+}
+
+func (b *BreakerStore) DeleteAccount(ctx context.Context, id int, force bool, actor string) error {
+	return b.run(func() error {
+		return b.store.DeleteAccount(ctx, id, force, actor)
+	})
+}
+
+func (b *BreakerStore) UpdateAccount(ctx context.Context, id int, req *UpdateAccountRequest, actor string) (acc *Account, err error) {
+	err = b.run(func() error {
+		acc, err = b.store.UpdateAccount(ctx, id, req, actor)
+		return err
+	})
+	return acc, err
+}
+
+func (b *BreakerStore) UpsertAccount(ctx context.Context, id int, req *UpdateAccountRequest, actor string) (acc *Account, created bool, err error) {
+	err = b.run(func() error {
+		acc, created, err = b.store.UpsertAccount(ctx, id, req, actor)
+		return err
+	})
+	return acc, created, err
+}
+
+func (b *BreakerStore) GetAccountByID(ctx context.Context, id int) (acc *Account, err error) {
+	err = b.run(func() error {
+		acc, err = b.store.GetAccountByID(ctx, id)
+		return err
+	})
+	return acc, err
+}
+
+func (b *BreakerStore) ListAccounts(ctx context.Context, filter AccountFilter, limit, offset int) (accounts []Account, total int, err error) {
+	err = b.run(func() error {
+		accounts, total, err = b.store.ListAccounts(ctx, filter, limit, offset)
+		return err
+	})
+	return accounts, total, err
+}
+
+func (b *BreakerStore) SearchAccounts(ctx context.Context, q string, limit int) (accounts []Account, err error) {
+	err = b.run(func() error {
+		accounts, err = b.store.SearchAccounts(ctx, q, limit)
+		return err
+	})
+	return accounts, err
+}
+
+func (b *BreakerStore) GetAccountBalanceByID(ctx context.Context, id int) (balance int64, err error) {
+	err = b.run(func() error {
+		balance, err = b.store.GetAccountBalanceByID(ctx, id)
+		return err
+	})
+	return balance, err
+}
+
+func (b *BreakerStore) GetBalancesByIDs(ctx context.Context, ids []int) (balances []BalanceResponse, err error) {
+	err = b.run(func() error {
+		balances, err = b.store.GetBalancesByIDs(ctx, ids)
+		return err
+	})
+	return balances, err
+}
+
+func (b *BreakerStore) GroupedBalances(ctx context.Context, field string) (rows []GroupRow, err error) {
+	err = b.run(func() error {
+		rows, err = b.store.GroupedBalances(ctx, field)
+		return err
+	})
+	return rows, err
+}
+
+func (b *BreakerStore) SetPIN(ctx context.Context, id int, pin string) error {
+	return b.run(func() error {
+		return b.store.SetPIN(ctx, id, pin)
+	})
+}
+
+func (b *BreakerStore) VerifyPIN(ctx context.Context, id int, pin string) (ok bool, err error) {
+	err = b.run(func() error {
+		ok, err = b.store.VerifyPIN(ctx, id, pin)
+		return err
+	})
+	return ok, err
+}
+
+func (b *BreakerStore) TransferBatch(ctx context.Context, from int, entries []TransferEntry, reference, actor string) (result *TransferBatchResult, err error) {
+	err = b.run(func() error {
+		result, err = b.store.TransferBatch(ctx, from, entries, reference, actor)
+		return err
+	})
+	return result, err
+}
+
+func (b *BreakerStore) GetAccountByNumber(ctx context.Context, number int64) (acc *Account, err error) {
+	err = b.run(func() error {
+		acc, err = b.store.GetAccountByNumber(ctx, number)
+		return err
+	})
+	return acc, err
+}
+
+func (b *BreakerStore) GetAuditLog(ctx context.Context, accountID int) (entries []AuditEntry, err error) {
+	err = b.run(func() error {
+		entries, err = b.store.GetAuditLog(ctx, accountID)
+		return err
+	})
+	return entries, err
+}
+
+func (b *BreakerStore) BalanceAsOf(ctx context.Context, id int, t time.Time) (balance int64, err error) {
+	err = b.run(func() error {
+		balance, err = b.store.BalanceAsOf(ctx, id, t)
+		return err
+	})
+	return balance, err
+}
+
+func (b *BreakerStore) GetStatement(ctx context.Context, id int, from, to time.Time) (statement *Statement, err error) {
+	err = b.run(func() error {
+		statement, err = b.store.GetStatement(ctx, id, from, to)
+		return err
+	})
+	return statement, err
+}
+
+func (b *BreakerStore) GetActivity(ctx context.Context, after *ActivityCursor, limit int) (entries []AuditEntry, err error) {
+	err = b.run(func() error {
+		entries, err = b.store.GetActivity(ctx, after, limit)
+		return err
+	})
+	return entries, err
+}
+
+// BeginTx starts a transaction on the wrapped store. the calls made in it go through the breaker as well
+func (b *BreakerStore) BeginTx(ctx context.Context) (TxStore, error) {
+	beginner, ok := b.store.(TxBeginner)
+	if !ok {
+		return nil, ErrTxUnsupported
+	}
+
+	var tx TxStore
+	err := b.run(func() (err error) {
+		tx, err = beginner.BeginTx(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &breakerTx{BreakerStore: &BreakerStore{store: tx, cb: b.cb}, tx: tx}, nil
+}
+
+// breakerTx is the TxStore BreakerStore.BeginTx returns, the same breaker in front of the transaction's calls
+type breakerTx struct {
+	*BreakerStore
+	tx TxStore
+}
+
+func (t *breakerTx) Commit() error { return t.run(t.tx.Commit) }
+
+// Rollback skips the breaker, it has to run even while the breaker is open to give the connection back
+func (t *breakerTx) Rollback() error { return t.tx.Rollback() }
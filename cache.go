@@ -0,0 +1,171 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// CachedStore is a decorator that puts an in-process LRU cache in front of GetAccountByID for any AccountStore.
+// every other method passes straight through to the wrapped store, and writes invalidate the id they touch
+type CachedStore struct {
+	AccountStore // the wrapped store, embedded so un-cached methods pass through
+
+	mu    sync.Mutex
+	size  int
+	order *list.List            // most recently used at the front, holds *Account values
+	items map[int]*list.Element // account id -> element in order
+	gen   uint64                // bumped on every invalidation so in-flight misses don't cache a stale row
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// NewCachedStore wraps store with an LRU cache holding at most size accounts
+func NewCachedStore(store AccountStore, size int) *CachedStore {
+	return &CachedStore{
+		AccountStore: store,
+		size:         size,
+		order:        list.New(),
+		items:        make(map[int]*list.Element),
+	}
+}
+
+// CacheStats returns the number of cache hits and misses since startup
+func (c *CachedStore) CacheStats() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+func (c *CachedStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	c.mu.Lock()
+	if el, ok := c.items[id]; ok {
+		c.order.MoveToFront(el)
+		acc := *el.Value.(*Account) // hand out a copy so callers can't mutate the cached value
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return &acc, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	acc, err := c.AccountStore.GetAccountByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a write happened while we were reading, what we have may already be stale so don't cache it
+	if gen != c.gen {
+		return acc, nil
+	}
+
+	cached := *acc
+	if el, ok := c.items[id]; ok {
+		el.Value = &cached
+		c.order.MoveToFront(el)
+	} else {
+		c.items[id] = c.order.PushFront(&cached)
+		if c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.items, oldest.Value.(*Account).ID)
+		}
+	}
+	return acc, nil
+}
+
+func (c *CachedStore) UpdateAccount(ctx context.Context, id int, req *UpdateAccountRequest, actor string) (*Account, error) {
+	defer c.invalidate(id)
+	return c.AccountStore.UpdateAccount(ctx, id, req, actor)
+}
+
+func (c *CachedStore) UpsertAccount(ctx context.Context, id int, req *UpdateAccountRequest, actor string) (*Account, bool, error) {
+	defer c.invalidate(id)
+	return c.AccountStore.UpsertAccount(ctx, id, req, actor)
+}
+
+func (c *CachedStore) DeleteAccount(ctx context.Context, id int, force bool, actor string) error {
+	defer c.invalidate(id)
+	return c.AccountStore.DeleteAccount(ctx, id, force, actor)
+}
+
+func (c *CachedStore) TransferBatch(ctx context.Context, fromID int, entries []TransferEntry, reference, actor string) (*TransferBatchResult, error) {
+	defer func() {
+		c.invalidate(fromID)
+		for _, e := range entries {
+			c.invalidate(e.ToAccountID)
+		}
+	}()
+	return c.AccountStore.TransferBatch(ctx, fromID, entries, reference, actor)
+}
+
+// invalidate drops id from the cache. It runs after the write (even a failed one, in case it partially applied)
+func (c *CachedStore) invalidate(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	if el, ok := c.items[id]; ok {
+		c.order.Remove(el)
+		delete(c.items, id)
+	}
+}
+
+// BeginTx starts a transaction on the wrapped store. calls in it skip the cache, they have to see the
+// transaction's own uncommitted writes, and the accounts it wrote are dropped from the cache once it commits
+func (c *CachedStore) BeginTx(ctx context.Context) (TxStore, error) {
+	beginner, ok := c.AccountStore.(TxBeginner)
+	if !ok {
+		return nil, ErrTxUnsupported
+	}
+	tx, err := beginner.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedTx{TxStore: tx, cache: c}, nil
+}
+
+// cachedTx is the TxStore CachedStore.BeginTx returns. it remembers the ids the transaction wrote, invalidating
+// them right away wouldn't do: a read before the commit would put the old row straight back in the cache
+type cachedTx struct {
+	TxStore
+	cache   *CachedStore
+	touched []int
+}
+
+func (t *cachedTx) UpdateAccount(ctx context.Context, id int, req *UpdateAccountRequest, actor string) (*Account, error) {
+	t.touched = append(t.touched, id)
+	return t.TxStore.UpdateAccount(ctx, id, req, actor)
+}
+
+func (t *cachedTx) UpsertAccount(ctx context.Context, id int, req *UpdateAccountRequest, actor string) (*Account, bool, error) {
+	t.touched = append(t.touched, id)
+	return t.TxStore.UpsertAccount(ctx, id, req, actor)
+}
+
+func (t *cachedTx) DeleteAccount(ctx context.Context, id int, force bool, actor string) error {
+	t.touched = append(t.touched, id)
+	return t.TxStore.DeleteAccount(ctx, id, force, actor)
+}
+
+func (t *cachedTx) TransferBatch(ctx context.Context, fromID int, entries []TransferEntry, reference, actor string) (*TransferBatchResult, error) {
+	t.touched = append(t.touched, fromID)
+	for _, e := range entries {
+		t.touched = append(t.touched, e.ToAccountID)
+	}
+	return t.TxStore.TransferBatch(ctx, fromID, entries, reference, actor)
+}
+
+// Commit commits and then invalidates every id the transaction wrote, even when the commit failed since
+// we can't tell whether it reached the database
+func (t *cachedTx) Commit() error {
+	defer func() {
+		for _, id := range t.touched {
+			t.cache.invalidate(id)
+		}
+	}()
+	return t.TxStore.Commit()
+}
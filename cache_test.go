@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCachedTxInvalidatesOnCommit(t *testing.T) {
+	ctx := context.Background()
+	cache := NewCachedStore(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 100}), 10)
+	if _, err := cache.GetAccountByID(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := cache.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	balance := int64(200)
+	if _, err := tx.UpdateAccount(ctx, 1, &UpdateAccountRequest{FirstName: "a", LastName: "b", Balance: &balance}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if acc, _ := tx.GetAccountByID(ctx, 1); acc.Balance != 200 {
+		t.Fatalf("balance in the transaction = %d, want its own write 200", acc.Balance)
+	}
+	if acc, _ := cache.GetAccountByID(ctx, 1); acc.Balance != 100 {
+		t.Fatalf("balance before commit = %d, want 100", acc.Balance)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if acc, _ := cache.GetAccountByID(ctx, 1); acc.Balance != 200 {
+		t.Fatalf("balance after commit = %d, want 200, the cache kept the old row", acc.Balance)
+	}
+	if hits, misses := cache.CacheStats(); hits != 1 || misses != 2 {
+		t.Fatalf("hits, misses = %d, %d, want 1, 2", hits, misses)
+	}
+}
+
+func TestCachedTxRollbackKeepsCache(t *testing.T) {
+	ctx := context.Background()
+	cache := NewCachedStore(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 100}), 10)
+	cache.GetAccountByID(ctx, 1)
+
+	tx, err := cache.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance := int64(200)
+	tx.UpdateAccount(ctx, 1, &UpdateAccountRequest{FirstName: "a", LastName: "b", Balance: &balance}, "test")
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if acc, _ := cache.GetAccountByID(ctx, 1); acc.Balance != 100 {
+		t.Fatalf("balance after rollback = %d, want 100", acc.Balance)
+	}
+	if hits, _ := cache.CacheStats(); hits != 1 {
+		t.Fatalf("hits = %d, want 1", hits)
+	}
+}
+
+func TestCachedStoreBeginTxUnsupported(t *testing.T) {
+	cache := NewCachedStore(struct{ AccountStore }{newMemStore()}, 10)
+	if _, err := cache.BeginTx(context.Background()); err != ErrTxUnsupported {
+		t.Fatalf("err = %v, want %v", err, ErrTxUnsupported)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// expectedSchema is every table and column the store reads or writes. Setup creates all of them,
+// VerifySchema checks they're actually there
+var expectedSchema = map[string][]string{
+	"accounts":            {"id", "first_name", "last_name", "number", "balance", "currency", "pin_hash", "daily_transfer_limit", "created_at", "updated_at"},
+	"audit_log":           {"id", "account_id", "action", "actor", "before", "after", "at"},
+	"transfer_references": {"reference", "from_account_id", "result"},
+}
+
+// VerifySchema checks that every table and column in expectedSchema exists, without changing anything.
+// each missing table or column is its own error in the joined result
+func (s *PostgresStore) VerifySchema(ctx context.Context) (err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	tables := slices.Sorted(maps.Keys(expectedSchema))
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT table_name, column_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ANY($1);
+	`, pq.Array(tables))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return err
+		}
+		if found[table] == nil {
+			found[table] = make(map[string]bool)
+		}
+		found[table][column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var problems []error
+	for _, table := range tables {
+		if found[table] == nil {
+			problems = append(problems, fmt.Errorf("table %s is missing", table))
+			continue
+		}
+		for _, column := range expectedSchema[table] {
+			if !found[table][column] {
+				problems = append(problems, fmt.Errorf("column %s.%s is missing", table, column))
+			}
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// selfCheckTimeout bounds the whole -check run so a hanging database fails the check instead of the deploy
+const selfCheckTimeout = 30 * time.Second
+
+// runSelfCheck is what -check does: load the config, connect to the database and verify the schema, printing
+// one pass/fail line per step to out. it stops at the first failed step (nothing after it could pass) and
+// returns the process exit code
+func runSelfCheck(out io.Writer) int {
+	ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+	defer cancel()
+
+	var store *PostgresStore
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"config", func() error {
+			_, err := LoadConfig()
+			return err
+		}},
+		{"database", func() (err error) {
+			store, err = NewPostgresStore()
+			return err
+		}},
+		{"schema", func() error {
+			return store.VerifySchema(ctx)
+		}},
+	}
+	defer func() {
+		if store != nil {
+			store.db.Close()
+		}
+	}()
+
+	for _, step := range steps {
+		err := step.run()
+		if err == nil {
+			fmt.Fprintf(out, "PASS  %s\n", step.name)
+			continue
+		}
+		fmt.Fprintf(out, "FAIL  %s\n", step.name)
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(out, "      %s\n", line)
+		}
+		return 1
+	}
+	fmt.Fprintln(out, "self-check passed")
+	return 0
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+)
+
+// limitConcurrency is a bulkhead: at most MAX_CONCURRENT_REQUESTS requests run at once, anything over that
+// gets a 503 right away instead of queueing up in front of a small DB pool. off when the limit isn't set
+func (s *APIServer) limitConcurrency(next http.Handler) http.Handler {
+	if s.cfg.MaxConcurrentRequests == 0 {
+		return next
+	}
+
+	slots := make(chan struct{}, s.cfg.MaxConcurrentRequests)
+
+	return makeHTTPHandleFunc(func(w http.ResponseWriter, req *http.Request) error {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return newRetryableError(http.StatusServiceUnavailable, busyRetryAfter, "the server is busy, try again shortly")
+		}
+		defer func() { <-slots }()
+
+		next.ServeHTTP(w, req)
+		return nil
+	})
+}
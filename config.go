@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds the server settings read from the environment (or .env)
+type Config struct {
+	// HTTP Basic Auth credentials, auth is disabled when both are empty
+	BasicAuthUser string
+	BasicAuthPass string
+
+	// AdminToken unlocks admin-only endpoints via the X-Admin-Token header, they're disabled when empty
+	AdminToken string
+
+	// StringNumbers makes account number/balance JSON strings for every client (JSON_STRING_NUMBERS=true)
+	StringNumbers bool
+
+	// MaskAccountNumbers sends account numbers as "******7890" to everyone but requests carrying the admin
+	// token (MASK_ACCOUNT_NUMBERS=true)
+	MaskAccountNumbers bool
+
+	// ResponseLinks adds _links to account responses for every client (RESPONSE_LINKS=true)
+	ResponseLinks bool
+
+	// PutUpsert makes PUT /account/{id} create the account when the id doesn't exist yet instead of
+	// returning a 404 (PUT_UPSERT=true)
+	PutUpsert bool
+
+	// BalanceEndpointGone makes the deprecated GET /account/{id}/balance answer 410 Gone once its sunset
+	// date has passed (BALANCE_ENDPOINT_GONE=true), otherwise it keeps working with deprecation headers
+	BalanceEndpointGone bool
+
+	// EnforceUniqueNames forbids two accounts with the same first and last name (ENFORCE_UNIQUE_NAMES=true).
+	// setup adds a unique index for it when it's on and drops the index when it's off
+	EnforceUniqueNames bool
+
+	// TrustedProxies are the proxies/load balancers whose X-Forwarded-For and X-Real-IP headers are believed
+	// when working out the client IP (TRUSTED_PROXIES, comma separated CIDRs or IPs). empty trusts nobody
+	TrustedProxies []netip.Prefix
+
+	// ExchangeRates converts cross-currency transfers (EXCHANGE_RATES, ex. "USD/EUR=0.92,EUR/USD=1.087").
+	// empty means cross-currency transfers are rejected
+	ExchangeRates StaticExchangeRates
+
+	// CORS says which browser origins may call which routes (CORS_ORIGINS for every route,
+	// CORS_ROUTE_ORIGINS for per-route overrides). empty means no CORS headers at all
+	CORS CORSConfig
+
+	// PublicRoutes skip basic auth, ex. "POST /account" for sign ups (PUBLIC_ROUTES, comma separated
+	// "METHOD /path" with {id} for ids, like CORS_ROUTE_ORIGINS). empty means every route needs auth
+	PublicRoutes map[string]bool
+
+	// AccountNumbers is the format of new account numbers (ACCOUNT_NUMBER_LENGTH, ACCOUNT_NUMBER_PREFIX).
+	// the zero value keeps the original unpadded numbers
+	AccountNumbers AccountNumberFormat
+
+	// page sizes for list endpoints, used by parsePagination (DEFAULT_PAGE_SIZE, MAX_PAGE_SIZE)
+	DefaultPageSize int
+	MaxPageSize     int
+
+	// ListHardCap is a deploy-wide ceiling no list request can go over, whatever MAX_PAGE_SIZE says
+	// (LIST_HARD_CAP, 0 means no extra cap)
+	ListHardCap int
+
+	// MaxConcurrentRequests caps how many API requests are handled at once, the rest get a 503
+	// (MAX_CONCURRENT_REQUESTS, 0 means no limit)
+	MaxConcurrentRequests int
+
+	// SlowRequestThreshold logs a warning for every request that takes longer (SLOW_REQUEST_THRESHOLD,
+	// a duration like 500ms, 0 turns it off)
+	SlowRequestThreshold time.Duration
+
+	// SnakeCaseJSON switches JSON keys to snake_case in responses and request bodies
+	// (JSON_FIELD_NAMING=snake_case, the default is camelCase)
+	SnakeCaseJSON bool
+
+	// ShutdownTimeout is how long in-flight requests get to finish after SIGTERM (SHUTDOWN_TIMEOUT, default 15s)
+	ShutdownTimeout time.Duration
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// LoadConfig reads the server config from environment variables
+func LoadConfig() (*Config, error) {
+	cfg := &Config{
+		BasicAuthUser: os.Getenv("BASIC_AUTH_USER"),
+		BasicAuthPass: os.Getenv("BASIC_AUTH_PASS"),
+		AdminToken:    os.Getenv("ADMIN_TOKEN"),
+
+		DefaultPageSize: defaultPageSize,
+		MaxPageSize:     maxPageSize,
+		ShutdownTimeout: defaultShutdownTimeout,
+	}
+
+	for _, setting := range []struct {
+		env string
+		dst *bool
+	}{
+		{"JSON_STRING_NUMBERS", &cfg.StringNumbers},
+		{"MASK_ACCOUNT_NUMBERS", &cfg.MaskAccountNumbers},
+		{"RESPONSE_LINKS", &cfg.ResponseLinks},
+		{"PUT_UPSERT", &cfg.PutUpsert},
+		{"BALANCE_ENDPOINT_GONE", &cfg.BalanceEndpointGone},
+		{"ENFORCE_UNIQUE_NAMES", &cfg.EnforceUniqueNames},
+	} {
+		if v := os.Getenv(setting.env); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", setting.env, v)
+			}
+			*setting.dst = b
+		}
+	}
+
+	for _, setting := range []struct {
+		env string
+		dst *int
+		min int // 0 for the settings where 0 turns the feature off
+	}{
+		{"DEFAULT_PAGE_SIZE", &cfg.DefaultPageSize, 1},
+		{"MAX_PAGE_SIZE", &cfg.MaxPageSize, 1},
+		{"LIST_HARD_CAP", &cfg.ListHardCap, 0},
+		{"MAX_CONCURRENT_REQUESTS", &cfg.MaxConcurrentRequests, 0},
+	} {
+		if v := os.Getenv(setting.env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < setting.min {
+				return nil, fmt.Errorf("invalid %s %q", setting.env, v)
+			}
+			*setting.dst = n
+		}
+	}
+	if cfg.DefaultPageSize > cfg.MaxPageSize {
+		return nil, fmt.Errorf("DEFAULT_PAGE_SIZE (%d) can't be bigger than MAX_PAGE_SIZE (%d)", cfg.DefaultPageSize, cfg.MaxPageSize)
+	}
+
+	if v := os.Getenv("SLOW_REQUEST_THRESHOLD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid SLOW_REQUEST_THRESHOLD %q", v)
+		}
+		cfg.SlowRequestThreshold = d
+	}
+
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid SHUTDOWN_TIMEOUT %q", v)
+		}
+		cfg.ShutdownTimeout = d
+	}
+
+	switch v := os.Getenv("JSON_FIELD_NAMING"); v {
+	case "", "camelCase":
+	case "snake_case":
+		cfg.SnakeCaseJSON = true
+	default:
+		return nil, fmt.Errorf("invalid JSON_FIELD_NAMING %q, expected camelCase or snake_case", v)
+	}
+
+	numberFormat, err := ParseAccountNumberFormat(os.Getenv("ACCOUNT_NUMBER_LENGTH"), os.Getenv("ACCOUNT_NUMBER_PREFIX"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.AccountNumbers = numberFormat
+
+	rates, err := ParseExchangeRates(os.Getenv("EXCHANGE_RATES"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.ExchangeRates = rates
+
+	publicRoutes, err := parseRouteKeys("PUBLIC_ROUTES", os.Getenv("PUBLIC_ROUTES"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.PublicRoutes = publicRoutes
+
+	corsCfg, err := ParseCORS(os.Getenv("CORS_ORIGINS"), os.Getenv("CORS_ROUTE_ORIGINS"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.CORS = corsCfg
+
+	proxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.TrustedProxies = proxies
+
+	// only one of them set is almost certainly a typo, and would otherwise quietly leave the API open
+	if (cfg.BasicAuthUser == "") != (cfg.BasicAuthPass == "") {
+		return nil, fmt.Errorf("BASIC_AUTH_USER and BASIC_AUTH_PASS must be set together")
+	}
+
+	return cfg, nil
+}
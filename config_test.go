@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestListHardCapConfig(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false}, // no cap, same as unset
+		{"50", 50, false},
+		{"-1", 0, true},
+		{"lots", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("LIST_HARD_CAP", tt.value)
+			cfg, err := LoadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LIST_HARD_CAP=%q loaded, want an error", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ListHardCap != tt.want {
+				t.Fatalf("ListHardCap = %d, want %d", cfg.ListHardCap, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentRequestsConfig(t *testing.T) {
+	t.Setenv("MAX_CONCURRENT_REQUESTS", "0")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxConcurrentRequests != 0 {
+		t.Fatalf("MaxConcurrentRequests = %d, want 0 (no limit)", cfg.MaxConcurrentRequests)
+	}
+
+	t.Setenv("MAX_CONCURRENT_REQUESTS", "-1")
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("MAX_CONCURRENT_REQUESTS=-1 loaded, want an error")
+	}
+}
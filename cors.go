@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// corsMaxAge is how long (in seconds) browsers may cache a preflight answer
+const corsMaxAge = 600
+
+// corsExposedHeaders are the response headers browser code is allowed to read besides the CORS safelisted ones
+var corsExposedHeaders = []string{"Link", "Retry-After", "Deprecation", "Sunset", limitCappedHeader}
+
+// CORSPolicy is the set of origins allowed to call a route from a browser. "*" allows any origin, but then
+// without credentials (basic auth) since browsers refuse to combine the two
+type CORSPolicy []string
+
+func (p CORSPolicy) allowsAny() bool {
+	return slices.Contains(p, "*")
+}
+
+func (p CORSPolicy) allows(origin string) bool {
+	return p.allowsAny() || slices.Contains(p, origin)
+}
+
+// CORSConfig is the CORS setup: Default applies to every route without an entry in Routes.
+// Routes is keyed by "METHOD /pattern" (ex. "POST /account", "GET /account/{id}"), see routePattern
+type CORSConfig struct {
+	Default CORSPolicy
+	Routes  map[string]CORSPolicy
+}
+
+// enabled reports whether any route allows cross-origin requests at all
+func (c CORSConfig) enabled() bool {
+	return len(c.Default) > 0 || len(c.Routes) > 0
+}
+
+// policyFor returns the policy for a method on a route pattern, falling back to the default
+func (c CORSConfig) policyFor(method, pattern string) CORSPolicy {
+	if p, ok := c.Routes[method+" "+pattern]; ok {
+		return p
+	}
+	return c.Default
+}
+
+// ParseCORS parses CORS_ORIGINS, a comma separated list of origins (or "*"), and CORS_ROUTE_ORIGINS,
+// per-route overrides separated by semicolons like "POST /account=*;GET /account/{id}=https://app.example.com"
+func ParseCORS(defaultOrigins, routeOrigins string) (CORSConfig, error) {
+	cfg := CORSConfig{Default: parseOrigins(defaultOrigins), Routes: map[string]CORSPolicy{}}
+
+	for _, part := range strings.Split(routeOrigins, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		route, origins, ok := strings.Cut(part, "=")
+		method, pattern, ok2 := strings.Cut(strings.TrimSpace(route), " ")
+		method, pattern = strings.ToUpper(method), strings.TrimSpace(pattern)
+		validMethod := slices.Contains([]string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}, method)
+		if !ok || !ok2 || !validMethod || !strings.HasPrefix(pattern, "/") {
+			return CORSConfig{}, fmt.Errorf("invalid CORS_ROUTE_ORIGINS entry %q, expected \"METHOD /path=origin,origin\"", part)
+		}
+		cfg.Routes[method+" "+pattern] = parseOrigins(origins)
+	}
+	return cfg, nil
+}
+
+func parseOrigins(v string) CORSPolicy {
+	var origins CORSPolicy
+	for _, origin := range strings.Split(v, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// routePattern turns a request path into the pattern CORS policies are keyed by: the version prefix is
+// dropped and ids become {id} (ex. /v1/account/42/balance => /account/{id}/balance)
+func routePattern(path string) string {
+	path = strings.TrimPrefix(path, "/"+apiVersion)
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		if _, err := strconv.Atoi(segment); err == nil {
+			segments[i] = "{id}"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// cors applies the CORS policy of the route a request is for. preflights are answered here, before
+// basic auth, since browsers never send credentials with them. requests without an Origin header and
+// origins the route doesn't allow get no CORS headers, which is what makes the browser block them
+func (s *APIServer) cors(next http.Handler) http.Handler {
+	if !s.cfg.CORS.enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		preflightMethod := req.Header.Get("Access-Control-Request-Method")
+		preflight := req.Method == http.MethodOptions && preflightMethod != ""
+
+		method := req.Method
+		if preflight {
+			method = preflightMethod
+		}
+		policy := s.cfg.CORS.policyFor(method, routePattern(req.URL.Path))
+
+		if policy.allows(origin) {
+			if policy.allowsAny() {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if preflight {
+				w.Header().Set("Access-Control-Allow-Methods", method)
+				if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			} else {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			}
+		}
+
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -1,25 +1,77 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// ErrAccountNotFound is wrapped by store methods when the account doesn't exist, the API turns it into a 404
+var ErrAccountNotFound = errors.New("no account found")
+
+// ErrDeleteNeedsConfirmation is wrapped by DeleteAccount when the account still has money or transfer
+// history and the delete wasn't forced, the API turns it into a 409
+var ErrDeleteNeedsConfirmation = errors.New("delete needs confirmation")
+
+// ErrQueryTimeout is wrapped by store methods that ran out of time, the API turns it into a 504
+var ErrQueryTimeout = errors.New("database operation timed out")
+
+// the context bounds how long a method may take (see PostgresStore.startOp).
+// the string passed to write methods is the actor recorded in the audit log (who made the change)
 type AccountStore interface { // interface since it defines the abstract behaviour of our store for Accounts
-	CreateAccount(*CreateAccountRequest) (*Account, error)
-	DeleteAccount(int) error
-	UpdateAccount(int, *UpdateAccountRequest) (*Account, error)
-	GetAccountByID(int) (*Account, error)
-	GetAccountBalanceByID(int) (int64, error)
+	CreateAccount(context.Context, *CreateAccountRequest, string) (*Account, error)
+	DeleteAccount(ctx context.Context, id int, force bool, actor string) error
+	UpdateAccount(context.Context, int, *UpdateAccountRequest, string) (*Account, error)
+	UpsertAccount(context.Context, int, *UpdateAccountRequest, string) (*Account, bool, error)
+	GetAccountByID(context.Context, int) (*Account, error)
+	ListAccounts(ctx context.Context, filter AccountFilter, limit, offset int) ([]Account, int, error)
+	SearchAccounts(ctx context.Context, q string, limit int) ([]Account, error)
+	GetAccountBalanceByID(context.Context, int) (int64, error)
+	GetBalancesByIDs(context.Context, []int) ([]BalanceResponse, error)
+	GroupedBalances(context.Context, string) ([]GroupRow, error)
+	SetPIN(context.Context, int, string) error
+	VerifyPIN(context.Context, int, string) (bool, error)
+	TransferBatch(ctx context.Context, fromID int, entries []TransferEntry, reference, actor string) (*TransferBatchResult, error)
+	GetAccountByNumber(context.Context, int64) (*Account, error)
+	GetAuditLog(context.Context, int) ([]AuditEntry, error)
+	GetActivity(ctx context.Context, after *ActivityCursor, limit int) ([]AuditEntry, error)
+	BalanceAsOf(ctx context.Context, id int, t time.Time) (int64, error)
+	GetStatement(ctx context.Context, id int, from, to time.Time) (*Statement, error)
 }
 
 type PostgresStore struct { // This will implmement the AccountStore interface. Go will implicitly know we implement it if it has all the required methods. Does not need an 'implements' or 'extends'
 	db *sql.DB
+
+	readRetries  int           // how many times idempotent reads are retried on transient errors (DB_READ_RETRIES)
+	retryBackoff time.Duration // base delay between read retries, doubled each attempt (DB_RETRY_BACKOFF)
+	queryTimeout time.Duration // deadline for each store operation when the caller didn't set one (DB_QUERY_TIMEOUT)
+
+	rates ExchangeRateProvider // converts cross-currency transfers, nil rejects them
+
+	numberFormat AccountNumberFormat // what new account numbers look like, the zero value is the original format
+	uniqueNames  bool                // ENFORCE_UNIQUE_NAMES, setup keeps accountNameIndex in line with it
+
+	schema string // DB_SCHEMA, empty means the default (public)
+
+	tx *sql.Tx // set on the view BeginTx returns, every call then runs in it (see q and begin)
 }
 
+// validSchemaName is what DB_SCHEMA may be. it's checked before the name goes into the connection string and
+// CREATE SCHEMA, so nothing that needs quoting (or could inject SQL) gets through
+var validSchemaName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
 func NewPostgresStore() (*PostgresStore, error) { // Constructor Function
 	user := os.Getenv("DB_USER")
 	pass := os.Getenv("DB_PASSWORD")
@@ -32,6 +84,29 @@ func NewPostgresStore() (*PostgresStore, error) { // Constructor Function
 		user, pass, host, port, name,
 	)
 
+	// DB_SCHEMA puts every table in its own schema, so several instances can share one database. the schema
+	// goes first on the search_path and public stays on it for extensions like pg_trgm
+	schema := os.Getenv("DB_SCHEMA")
+	if schema != "" {
+		if !validSchemaName.MatchString(schema) {
+			return nil, fmt.Errorf("invalid DB_SCHEMA %q, expected lowercase letters, digits and underscores", schema)
+		}
+		connStr += "&search_path=" + url.QueryEscape(schema+",public")
+	}
+
+	// DB_STATEMENT_TIMEOUT has Postgres itself cancel any statement running longer, on every connection in the pool.
+	// it's the backstop for DB_QUERY_TIMEOUT: a statement stuck on a lock gets killed even if nobody on our side
+	// is left to cancel it. Postgres counts in milliseconds, 0 (the default) leaves the server's setting alone
+	if v := os.Getenv("DB_STATEMENT_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 || (timeout > 0 && timeout < time.Millisecond) {
+			return nil, fmt.Errorf("invalid DB_STATEMENT_TIMEOUT %q, expected a duration of at least 1ms (or 0 to turn it off)", v)
+		}
+		if timeout > 0 {
+			connStr += "&statement_timeout=" + strconv.FormatInt(timeout.Milliseconds(), 10)
+		}
+	}
+
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
@@ -41,37 +116,211 @@ func NewPostgresStore() (*PostgresStore, error) { // Constructor Function
 		return nil, err
 	}
 
-	fmt.Println("Connected to PostgreSQL!")
+	readRetries := defaultReadRetries
+	if v := os.Getenv("DB_READ_RETRIES"); v != "" {
+		readRetries, err = strconv.Atoi(v)
+		if err != nil || readRetries < 0 {
+			return nil, fmt.Errorf("invalid DB_READ_RETRIES %q", v)
+		}
+	}
+
+	retryBackoff := defaultRetryBackoff
+	if v := os.Getenv("DB_RETRY_BACKOFF"); v != "" {
+		retryBackoff, err = time.ParseDuration(v)
+		if err != nil || retryBackoff < 0 {
+			return nil, fmt.Errorf("invalid DB_RETRY_BACKOFF %q", v)
+		}
+	}
+
+	queryTimeout := defaultQueryTimeout
+	if v := os.Getenv("DB_QUERY_TIMEOUT"); v != "" {
+		queryTimeout, err = time.ParseDuration(v)
+		if err != nil || queryTimeout < 0 {
+			return nil, fmt.Errorf("invalid DB_QUERY_TIMEOUT %q", v)
+		}
+	}
+
+	slog.Info("Connected to PostgreSQL!")
 	return &PostgresStore{
-		db: db,
+		db:           db,
+		schema:       schema,
+		readRetries:  readRetries,
+		retryBackoff: retryBackoff,
+		queryTimeout: queryTimeout,
 	}, nil
 }
 
-// Setup initializes the accounts table and triggers
+// setupLockKey is the pg_advisory_lock key that serializes schema setup across instances. any constant works
+// as long as nothing else in the database uses the same one
+const setupLockKey int64 = 0x676f62616e6b // "gobank"
+
+// Setup creates/migrates the schema. it holds an advisory lock while it runs so that several instances
+// starting at once take turns instead of racing each other on CREATE TRIGGER and friends
 func (s *PostgresStore) Setup() error {
-	if err := s.createAccountTable(); err != nil {
+	ctx := context.Background()
+
+	// advisory locks belong to a session, so lock and unlock have to go through the same connection.
+	// the setup steps themselves can use any connection from the pool
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
 		return err
 	}
-	if err := s.createUpdatedAtTrigger(); err != nil {
-		return err
+	defer conn.Close()
+
+	// waiting for another instance's setup can take longer than DB_STATEMENT_TIMEOUT, so the wait doesn't get one.
+	// RESET puts the connection back to the DB_STATEMENT_TIMEOUT it was opened with before it goes back to the pool
+	if _, err := conn.ExecContext(ctx, "SET statement_timeout = 0"); err != nil {
+		return fmt.Errorf("acquire setup lock: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", setupLockKey); err != nil {
+		return fmt.Errorf("acquire setup lock: %w", err)
+	}
+	defer func() {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", setupLockKey)
+		if err == nil {
+			_, err = conn.ExecContext(ctx, "RESET statement_timeout")
+		}
+		if err != nil {
+			// throw the connection away instead of handing it back to the pool, ending the session
+			// releases the lock
+			slog.Warn("failed to release setup lock", "error", err)
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	return s.runSetup()
+}
+
+// runSetup runs every setup step in order, the error names the step that failed.
+// Setup runs on every start, against fresh and existing databases alike, so every step has to be idempotent:
+// IF NOT EXISTS, drop + create in a transaction, or a DO block that checks before it changes anything.
+// later steps can rely on the earlier ones, new steps go at the end
+func (s *PostgresStore) runSetup() error {
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"create schema", s.createSchema},
+		{"create accounts table", s.createAccountTable},
+		{"add account columns", s.addAccountColumns},
+		{"create account number sequence", s.createAccountNumberSequence},
+		{"migrate timestamps to timestamptz", s.migrateTimestampsToTZ},
+		{"create updated_at trigger", s.createUpdatedAtTrigger},
+		{"create audit log table", s.createAuditLogTable},
+		{"create name search index", s.createNameSearchIndex},
+		{"create account number unique index", s.createAccountNumberIndex},
+		{"sync account name unique index", s.syncAccountNameIndex},
+		{"create transfer references table", s.createTransferReferencesTable},
+	}
+
+	for _, step := range steps {
+		slog.Info("running setup step", "step", step.name)
+		if err := step.run(); err != nil {
+			return fmt.Errorf("setup step %q: %w", step.name, err)
+		}
 	}
 	return nil
 }
 
+// createSchema creates the DB_SCHEMA schema, with no DB_SCHEMA everything lives in public and there's nothing to do
+func (s *PostgresStore) createSchema() error {
+	if s.schema == "" {
+		return nil
+	}
+	// validSchemaName already made sure the name is safe to put in the query as is
+	_, err := s.db.Exec(`CREATE SCHEMA IF NOT EXISTS ` + s.schema + `;`)
+	return err
+}
+
 func (s *PostgresStore) createAccountTable() error {
 	query := `CREATE TABLE IF NOT EXISTS accounts (
 		id SERIAL PRIMARY KEY,
 		first_name VARCHAR(50),
 		last_name VARCHAR(50),
-		number SERIAL,
+		number BIGSERIAL,
 		balance BIGINT DEFAULT 0,
-		created_at TIMESTAMP DEFAULT now(),
-		updated_at TIMESTAMP DEFAULT now()
+		currency CHAR(3) NOT NULL DEFAULT 'USD',
+		pin_hash TEXT,
+		created_at TIMESTAMPTZ DEFAULT now(),
+		updated_at TIMESTAMPTZ DEFAULT now()
 	);`
 	_, err := s.db.Exec(query)
 	return err
 }
 
+// addAccountColumns adds the columns introduced after the first version of the accounts table, for tables created before them
+func (s *PostgresStore) addAccountColumns() error {
+	queries := []string{
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS pin_hash TEXT;`,
+		// in minor units, 0 means no limit
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS daily_transfer_limit BIGINT NOT NULL DEFAULT 0;`,
+		// numbers carry a check digit now, so they need more room than the int4 SERIAL gave them. only done while
+		// the column is still an int4, even a no-op ALTER TYPE takes an exclusive lock on the table
+		`DO $$
+		BEGIN
+			IF EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_schema = current_schema()
+				  AND table_name = 'accounts'
+				  AND column_name = 'number'
+				  AND data_type = 'integer'
+			) THEN
+				ALTER TABLE accounts ALTER COLUMN number TYPE BIGINT;
+			END IF;
+		END $$;`,
+	}
+	for _, query := range queries {
+		if _, err := s.db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createAccountNumberSequence gives account numbers their own sequence. tables that predate it already
+// have one from the BIGSERIAL column, which is renamed rather than replaced so numbering carries on where
+// it was (and instances still calling nextval on the serial sequence keep drawing from the same one)
+func (s *PostgresStore) createAccountNumberSequence() error {
+	query := `
+	DO $$
+	BEGIN
+		IF to_regclass(quote_ident(current_schema()) || '.` + accountNumberSequence + `') IS NULL THEN
+			IF pg_get_serial_sequence('accounts', 'number') IS NOT NULL THEN
+				EXECUTE format('ALTER SEQUENCE %s RENAME TO ` + accountNumberSequence + `', pg_get_serial_sequence('accounts', 'number'));
+			ELSE
+				CREATE SEQUENCE ` + accountNumberSequence + `;
+			END IF;
+		END IF;
+	END $$;
+	`
+	_, err := s.db.Exec(query)
+	return err
+}
+
+// migrateTimestampsToTZ converts created_at/updated_at from TIMESTAMP to TIMESTAMPTZ on tables created before the switch.
+// the old values were written by now() in the server's zone, so they're interpreted in that zone (which is also what a plain cast does)
+func (s *PostgresStore) migrateTimestampsToTZ() error {
+	query := `
+	DO $$
+	BEGIN
+		IF EXISTS (
+			SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema()
+			  AND table_name = 'accounts'
+			  AND column_name IN ('created_at', 'updated_at')
+			  AND data_type = 'timestamp without time zone'
+		) THEN
+			ALTER TABLE accounts
+				ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE current_setting('TimeZone'),
+				ALTER COLUMN updated_at TYPE TIMESTAMPTZ USING updated_at AT TIME ZONE current_setting('TimeZone');
+		END IF;
+	END $$;
+	`
+	_, err := s.db.Exec(query)
+	return err
+}
+
 func (s *PostgresStore) createUpdatedAtTrigger() error {
 	fn := `
 	CREATE OR REPLACE FUNCTION set_updated_at()
@@ -82,7 +331,10 @@ func (s *PostgresStore) createUpdatedAtTrigger() error {
 	END;
 	$$ LANGUAGE plpgsql;
 	`
-	tr := `
+	// drop + create in one transaction makes this idempotent on every Postgres version, without matching on
+	// the "already exists" error message (CREATE OR REPLACE TRIGGER would also work but needs PG14+)
+	drop := `DROP TRIGGER IF EXISTS trigger_set_updated_at ON accounts;`
+	create := `
 	CREATE TRIGGER trigger_set_updated_at
 	BEFORE UPDATE ON accounts
 	FOR EACH ROW
@@ -92,94 +344,449 @@ func (s *PostgresStore) createUpdatedAtTrigger() error {
 	if _, err := s.db.Exec(fn); err != nil {
 		return err
 	}
-	if _, err := s.db.Exec(tr); err != nil {
-		// ignore "already exists" errors silently
-		if err.Error() != `pq: trigger "trigger_set_updated_at" for relation "accounts" already exists` {
+	return s.execTx(drop, create)
+}
+
+// execTx runs queries one after the other in a transaction. a BEGIN; ... COMMIT; in one multi-statement Exec
+// would do the same until a statement fails: then the connection goes back to the pool still in the aborted
+// transaction, and whatever runs on it next fails
+func (s *PostgresStore) execTx(queries ...string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
 			return err
 		}
 	}
+	return tx.Commit()
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanAccount scans a row selected as "id, first_name, last_name, number, balance, currency, created_at, updated_at" into acc.
+// every nullable column is scanned through a sql.Null* type and a NULL becomes the field's zero value, so rows with
+// gaps (ex. inserted by hand or before a column got its default) don't fail to scan.
+// timestamps are normalized to UTC so they always marshal with a "Z" suffix no matter the server's local zone
+func scanAccount(row rowScanner, acc *Account) error {
+	var (
+		firstName, lastName  sql.NullString
+		balance              sql.NullInt64
+		createdAt, updatedAt sql.NullTime
+	)
+
+	err := row.Scan(
+		&acc.ID,
+		&firstName,
+		&lastName,
+		&acc.Number,
+		&balance,
+		&acc.Currency,
+		&createdAt,
+		&updatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	acc.FirstName = firstName.String
+	acc.LastName = lastName.String
+	acc.Balance = balance.Int64
+	acc.CreatedAt = nullTimeUTC(createdAt)
+	acc.UpdatedAt = nullTimeUTC(updatedAt)
 	return nil
 }
 
-func (s *PostgresStore) CreateAccount(req *CreateAccountRequest) (*Account, error) {
+// nullTimeUTC returns t in UTC, or the zero time if it was NULL
+func nullTimeUTC(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time.UTC()
+}
+
+// accountNumberSequence hands out account number payloads, see nextAccountNumber
+const accountNumberSequence = "account_number_seq"
+
+// accountNumberIndex keeps account numbers unique, CreateAccount retries when it trips it
+const accountNumberIndex = "accounts_number_key"
+
+// createAccountNumberIndex adds the unique index on accounts.number. it fails if the table already has
+// duplicate numbers, those have to be fixed by hand before the index (and the server) can go in
+func (s *PostgresStore) createAccountNumberIndex() error {
+	_, err := s.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS ` + accountNumberIndex + ` ON accounts (number);`)
+	return err
+}
+
+// accountNameIndex is the unique index on (first_name, last_name) that ENFORCE_UNIQUE_NAMES adds
+const accountNameIndex = "accounts_name_key"
+
+// ErrDuplicateName is what creating or renaming an account returns when another account already has the name
+// and ENFORCE_UNIQUE_NAMES is on
+var ErrDuplicateName = errors.New("another account already has this name")
+
+// syncAccountNameIndex adds accountNameIndex when ENFORCE_UNIQUE_NAMES is on and drops it when it's off, so
+// turning the setting off takes effect on the next start. like the number index, adding it fails while the
+// table has duplicate names
+func (s *PostgresStore) syncAccountNameIndex() error {
+	query := `DROP INDEX IF EXISTS ` + accountNameIndex + `;`
+	if s.uniqueNames {
+		query = `CREATE UNIQUE INDEX IF NOT EXISTS ` + accountNameIndex + ` ON accounts (first_name, last_name);`
+	}
+	_, err := s.db.Exec(query)
+	return err
+}
+
+// duplicateNameError turns a violation of accountNameIndex into ErrDuplicateName, any other error comes back as is
+func duplicateNameError(err error, firstName, lastName string) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == accountNameIndex { // unique_violation
+		return fmt.Errorf("%w: %s %s", ErrDuplicateName, firstName, lastName)
+	}
+	return err
+}
+
+// nextAccountNumber takes the next value from accountNumberSequence and turns it into an account number in
+// s.numberFormat (with a Luhn check digit). nextval never gives the same value twice, even to concurrent
+// transactions, so numbers are unique without retrying on conflicts. a rolled back create just leaves a gap
+func (s *PostgresStore) nextAccountNumber(ctx context.Context, tx querier) (int64, error) {
+	var seq int64
+	if err := tx.QueryRowContext(ctx, `SELECT nextval($1);`, accountNumberSequence).Scan(&seq); err != nil {
+		return 0, err
+	}
+	return s.numberFormat.number(seq)
+}
+
+func (s *PostgresStore) CreateAccount(ctx context.Context, req *CreateAccountRequest, actor string) (_ *Account, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
 	query := `
-		INSERT INTO accounts (first_name, last_name)
-		VALUES ($1, $2)
-		RETURNING id, first_name, last_name, number, balance, created_at, updated_at;
+		INSERT INTO accounts (first_name, last_name, currency, pin_hash, number, balance)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, first_name, last_name, number, balance, currency, created_at, updated_at;
 	`
 
-	row := s.db.QueryRow(query, req.FirstName, req.LastName)
+	// the PIN is optional, accounts created without one have a NULL pin_hash until SetPIN is called
+	var pinHash sql.NullString
+	if req.PIN != "" {
+		hash, err := hashPIN(req.PIN)
+		if err != nil {
+			return nil, err
+		}
+		pinHash = sql.NullString{String: hash, Valid: true}
+	}
 
+	// nothing is written unless the whole transaction commits, so a create that lost a race can safely run again
 	var created Account
-	err := row.Scan(
-		&created.ID,
-		&created.FirstName,
-		&created.LastName,
-		&created.Number,
-		&created.Balance,
-		&created.CreatedAt,
-		&created.UpdatedAt,
-	)
+	err = s.withCreateRetry(ctx, func() error {
+		tx, err := s.begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() // no-op once committed
+
+		number, err := s.nextAccountNumber(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		// the opening balance goes in with the row itself, so an account never exists unfunded
+		row := tx.QueryRowContext(ctx, query, req.FirstName, req.LastName, req.Currency, pinHash, number, req.InitialBalance)
+		if err := scanAccount(row, &created); err != nil {
+			return duplicateNameError(err, req.FirstName, req.LastName)
+		}
+
+		if err := insertAudit(ctx, tx, created.ID, AuditCreate, actor, nil, created); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
 	if err != nil {
 		return nil, err
 	}
 	return &created, nil
 }
 
-func (s *PostgresStore) UpdateAccount(id int, req *UpdateAccountRequest) (*Account, error) {
+// lockAccount selects an account row FOR UPDATE inside tx, returning sql.ErrNoRows if it doesn't exist
+func lockAccount(ctx context.Context, tx querier, id int) (*Account, error) {
+	query := `
+		SELECT id, first_name, last_name, number, balance, currency, created_at, updated_at
+		FROM accounts
+		WHERE id = $1
+		FOR UPDATE;
+	`
+
+	var acc Account
+	if err := scanAccount(tx.QueryRowContext(ctx, query, id), &acc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+// UpdateAccount sets the account's names, and its balance too unless req.Balance is nil
+func (s *PostgresStore) UpdateAccount(ctx context.Context, id int, req *UpdateAccountRequest, actor string) (_ *Account, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
 	query := `
 		UPDATE accounts
-		SET first_name = $1, last_name = $2, balance = $3
+		SET first_name = $1, last_name = $2, balance = COALESCE($3, balance)
 		WHERE id = $4
-		RETURNING id, first_name, last_name, number, balance, created_at, updated_at;
+		RETURNING id, first_name, last_name, number, balance, currency, created_at, updated_at;
 	`
 
-	row := s.db.QueryRow(query, req.FirstName, req.LastName, req.Balance, id)
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once committed
 
-	var updated Account
-	err := row.Scan(
-		&updated.ID,
-		&updated.FirstName,
-		&updated.LastName,
-		&updated.Number,
-		&updated.Balance,
-		&updated.CreatedAt,
-		&updated.UpdatedAt,
-	)
+	// this also covers losing a race with a delete: the lock waits for the delete to commit and then finds nothing
+	before, err := lockAccount(ctx, tx, id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w with id %d", ErrAccountNotFound, id)
+	}
 	if err != nil {
 		return nil, err
 	}
+
+	row := tx.QueryRowContext(ctx, query, req.FirstName, req.LastName, req.Balance, id)
+
+	var updated Account
+	if err := scanAccount(row, &updated); err != nil {
+		return nil, duplicateNameError(err, req.FirstName, req.LastName)
+	}
+
+	if err := insertAudit(ctx, tx, id, AuditUpdate, actor, before, updated); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	return &updated, nil
 }
 
-func (s *PostgresStore) DeleteAccount(id int) error {
+// UpsertAccount is UpdateAccount that creates the account under the given id when it doesn't exist yet
+// (PUT_UPSERT=true). the bool reports whether it was created
+func (s *PostgresStore) UpsertAccount(ctx context.Context, id int, req *UpdateAccountRequest, actor string) (_ *Account, _ bool, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	query := `
+		INSERT INTO accounts (id, first_name, last_name, balance, number)
+		VALUES ($1, $2, $3, COALESCE($4::bigint, 0), $5)
+		ON CONFLICT (id) DO UPDATE
+		SET first_name = EXCLUDED.first_name, last_name = EXCLUDED.last_name, balance = COALESCE($4::bigint, accounts.balance)
+		RETURNING id, first_name, last_name, number, balance, currency, created_at, updated_at;
+	`
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	// lock the row if it's there so the audit entry gets an accurate "before"
+	before, err := lockAccount(ctx, tx, id)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, err
+	}
+	created := err == sql.ErrNoRows
+
+	// a number is only used when the row gets inserted, same scheme as CreateAccount. if a concurrent
+	// upsert inserts the same id first, ours turns into an update and the sequence value is simply skipped
+	// (it's still reported as created, the two requests wanted the same end state anyway)
+	var number int64
+	if created {
+		if number, err = s.nextAccountNumber(ctx, tx); err != nil {
+			return nil, false, err
+		}
+	}
+
+	var upserted Account
+	row := tx.QueryRowContext(ctx, query, id, req.FirstName, req.LastName, req.Balance, number)
+	if err := scanAccount(row, &upserted); err != nil {
+		return nil, false, duplicateNameError(err, req.FirstName, req.LastName)
+	}
+
+	action := AuditUpdate
+	if created {
+		action = AuditCreate
+		// an explicit id doesn't move the id sequence, bump it past this id so POST doesn't collide with it later
+		bump := `SELECT setval(pg_get_serial_sequence('accounts', 'id'), (SELECT MAX(id) FROM accounts));`
+		if _, err := tx.ExecContext(ctx, bump); err != nil {
+			return nil, false, err
+		}
+	}
+
+	var beforeState any
+	if before != nil {
+		beforeState = before
+	}
+	if err := insertAudit(ctx, tx, id, action, actor, beforeState, upserted); err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return &upserted, created, nil
+}
+
+// DeleteAccount deletes an account. unless force is set it refuses (ErrDeleteNeedsConfirmation) to delete one
+// that still holds money or has ever been part of a transfer. that's checked under the row lock, so a transfer
+// can't slip in between the check and the delete
+func (s *PostgresStore) DeleteAccount(ctx context.Context, id int, force bool, actor string) (err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	// if a concurrent request deleted it first, the lock waits for that to commit and then finds nothing
+	before, err := lockAccount(ctx, tx, id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w with id %d", ErrAccountNotFound, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		var transfers bool
+		transfersQuery := `SELECT EXISTS (SELECT 1 FROM audit_log WHERE account_id = $1 AND action = $2);`
+		if err := tx.QueryRowContext(ctx, transfersQuery, id, AuditTransfer).Scan(&transfers); err != nil {
+			return err
+		}
+		switch {
+		case before.Balance != 0:
+			return fmt.Errorf("%w: account %d still has a balance of %s", ErrDeleteNeedsConfirmation, id, FormatAmount(before.Balance, before.Currency))
+		case transfers:
+			return fmt.Errorf("%w: account %d has transfer history", ErrDeleteNeedsConfirmation, id)
+		}
+	}
+
 	query := `DELETE FROM accounts WHERE id = $1;`
-	_, err := s.db.Exec(query, id)
-	return err
+	result, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w with id %d", ErrAccountNotFound, id)
+	}
+
+	if err := insertAudit(ctx, tx, id, AuditDelete, actor, before, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *PostgresStore) GetAccountByID(id int) (*Account, error) {
+func (s *PostgresStore) GetAccountByID(ctx context.Context, id int) (_ *Account, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
 	query := `
-		SELECT id, first_name, last_name, number, balance, created_at, updated_at
+		SELECT id, first_name, last_name, number, balance, currency, created_at, updated_at
 		FROM accounts
 		WHERE id = $1;
 	`
 
-	row := s.db.QueryRow(query, id)
+	var acc Account
+	err = s.withReadRetry(ctx, func() error {
+		return scanAccount(s.q().QueryRowContext(ctx, query, id), &acc)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w with id %d", ErrAccountNotFound, id)
+		}
+		return nil, err
+	}
+
+	return &acc, nil
+}
+
+// ListAccounts returns one page of the accounts matching filter ordered by id, along with the total number of matches
+func (s *PostgresStore) ListAccounts(ctx context.Context, filter AccountFilter, limit, offset int) (_ []Account, _ int, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	where, args := filter.where()
+	query := fmt.Sprintf(`
+		SELECT id, first_name, last_name, number, balance, currency, created_at, updated_at
+		FROM accounts
+		%s
+		ORDER BY id
+		LIMIT $%d OFFSET $%d;
+	`, where, len(args)+1, len(args)+2)
+	// counted separately instead of COUNT(*) OVER () so a page past the end still knows the total
+	countQuery := `SELECT COUNT(*) FROM accounts ` + where + `;`
+
+	var accounts []Account
+	var total int
+	err = s.withReadRetry(ctx, func() error {
+		if err := s.q().QueryRowContext(ctx, countQuery, args...).Scan(&total); err != nil {
+			return err
+		}
+
+		rows, err := s.q().QueryContext(ctx, query, append(args, limit, offset)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		accounts = []Account{}
+		for rows.Next() {
+			var acc Account
+			if err := scanAccount(rows, &acc); err != nil {
+				return err
+			}
+			accounts = append(accounts, acc)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return accounts, total, nil
+}
+
+// GetAccountByNumber looks an account up by its account number. numbers issued before the check digit was
+// added mostly fail the Luhn check, so a failed check still gets looked up, and it's only reported as a typo
+// (invalid rather than not found) when no account has it
+func (s *PostgresStore) GetAccountByNumber(ctx context.Context, number int64) (_ *Account, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	query := `
+		SELECT id, first_name, last_name, number, balance, currency, created_at, updated_at
+		FROM accounts
+		WHERE number = $1;
+	`
 
 	var acc Account
-	err := row.Scan(
-		&acc.ID,
-		&acc.FirstName,
-		&acc.LastName,
-		&acc.Number,
-		&acc.Balance,
-		&acc.CreatedAt,
-		&acc.UpdatedAt,
-	)
+	err = s.withReadRetry(ctx, func() error {
+		return scanAccount(s.q().QueryRowContext(ctx, query, number), &acc)
+	})
 	if err != nil {
+		if err == sql.ErrNoRows && !ValidateAccountNumber(number) {
+			return nil, fmt.Errorf("invalid account number %d, check for typos", number)
+		}
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("no account found with id %d", id)
+			return nil, fmt.Errorf("%w with number %d", ErrAccountNotFound, number)
 		}
 		return nil, err
 	}
@@ -187,17 +794,454 @@ func (s *PostgresStore) GetAccountByID(id int) (*Account, error) {
 	return &acc, nil
 }
 
-func (s *PostgresStore) GetAccountBalanceByID(id int) (int64, error) {
+func (s *PostgresStore) GetAccountBalanceByID(ctx context.Context, id int) (_ int64, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
 	query := `SELECT balance FROM accounts WHERE id = $1;`
 
-	var balance int64
-	err := s.db.QueryRow(query, id).Scan(&balance)
+	var balance sql.NullInt64 // a NULL balance reads as 0
+	err = s.withReadRetry(ctx, func() error {
+		return s.q().QueryRowContext(ctx, query, id).Scan(&balance)
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, fmt.Errorf("no account found with id %d", id)
+			return 0, fmt.Errorf("%w with id %d", ErrAccountNotFound, id)
 		}
 		return 0, err
 	}
 
-	return balance, nil
+	return balance.Int64, nil
+}
+
+// BalanceAsOf returns the balance account id had at time t. there's no transactions table to sum, but every
+// change to a balance (create, update, transfer) is in the audit log with the balance after it, so the answer
+// is the last of those at or before t
+func (s *PostgresStore) BalanceAsOf(ctx context.Context, id int, t time.Time) (_ int64, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	query := `
+		SELECT a.created_at, (
+			SELECT (l.after->>'balance')::bigint
+			FROM audit_log l
+			WHERE l.account_id = a.id AND l.at <= $2 AND l.after ? 'balance'
+			ORDER BY l.at DESC, l.id DESC
+			LIMIT 1
+		)
+		FROM accounts a
+		WHERE a.id = $1;
+	`
+
+	var createdAt sql.NullTime
+	var balance sql.NullInt64
+	err = s.withReadRetry(ctx, func() error {
+		return s.q().QueryRowContext(ctx, query, id, t).Scan(&createdAt, &balance)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("%w with id %d", ErrAccountNotFound, id)
+		}
+		return 0, err
+	}
+
+	if createdAt.Valid && t.Before(createdAt.Time) {
+		return 0, fmt.Errorf("%w: account %d was created at %s", ErrNoBalanceHistory, id, createdAt.Time.UTC().Format(time.RFC3339))
+	}
+	if !balance.Valid {
+		// the account predates the audit log, its early balances were never recorded
+		return 0, fmt.Errorf("%w: the audit log has no balance for account %d at or before %s", ErrNoBalanceHistory, id, t.UTC().Format(time.RFC3339))
+	}
+	return balance.Int64, nil
+}
+
+// GetBalancesByIDs returns the balance and currency of every account in ids that exists, in one query.
+// ids that don't exist are simply left out, the order of the result is unspecified
+func (s *PostgresStore) GetBalancesByIDs(ctx context.Context, ids []int) (_ []BalanceResponse, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	query := `SELECT id, balance, currency FROM accounts WHERE id = ANY($1);`
+
+	ids64 := make([]int64, len(ids))
+	for i, id := range ids {
+		ids64[i] = int64(id)
+	}
+
+	var balances []BalanceResponse
+	err = s.withReadRetry(ctx, func() error {
+		rows, err := s.q().QueryContext(ctx, query, pq.Array(ids64))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		balances = []BalanceResponse{}
+		for rows.Next() {
+			var b BalanceResponse
+			var balance sql.NullInt64 // a NULL balance reads as 0
+			if err := rows.Scan(&b.ID, &balance, &b.Currency); err != nil {
+				return err
+			}
+			b.Balance = balance.Int64
+			balances = append(balances, b)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return balances, nil
+}
+
+// groupableColumns whitelists the fields GroupedBalances can group by, mapping the API name to the column.
+// the column gets formatted into the query so it must never come straight from the request
+var groupableColumns = map[string]string{
+	"firstName": "first_name",
+	"lastName":  "last_name",
+	"currency":  "currency",
+}
+
+// GroupedBalances returns the account count and total balance for each distinct value of field (ex. "lastName")
+func (s *PostgresStore) GroupedBalances(ctx context.Context, field string) (_ []GroupRow, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	column, ok := groupableColumns[field]
+	if !ok {
+		return nil, fmt.Errorf("cannot group by %q", field)
+	}
+
+	// grouped by the COALESCE, not the column, so NULL and '' come back as one "" group instead of two
+	query := fmt.Sprintf(`
+		SELECT COALESCE(%[1]s, ''), COUNT(*), COALESCE(SUM(balance), 0)
+		FROM accounts
+		GROUP BY COALESCE(%[1]s, '')
+		ORDER BY COALESCE(%[1]s, '');
+	`, column)
+
+	var groups []GroupRow
+	err = s.withReadRetry(ctx, func() error {
+		rows, err := s.q().QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		groups = []GroupRow{} // reset in case a previous attempt failed part way through
+		for rows.Next() {
+			var g GroupRow
+			if err := rows.Scan(&g.Group, &g.Count, &g.TotalBalance); err != nil {
+				return err
+			}
+			groups = append(groups, g)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// SetPIN replaces the account's PIN, storing only its bcrypt hash
+func (s *PostgresStore) SetPIN(ctx context.Context, id int, pin string) (err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	if err := validatePIN(pin); err != nil {
+		return err
+	}
+
+	hash, err := hashPIN(pin)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE accounts SET pin_hash = $1 WHERE id = $2;`
+	result, err := s.q().ExecContext(ctx, query, hash, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w with id %d", ErrAccountNotFound, id)
+	}
+	return nil
+}
+
+// VerifyPIN reports whether pin matches the account's stored PIN. Accounts without a PIN never match
+func (s *PostgresStore) VerifyPIN(ctx context.Context, id int, pin string) (_ bool, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	query := `SELECT pin_hash FROM accounts WHERE id = $1;`
+
+	var hash sql.NullString
+	err = s.withReadRetry(ctx, func() error {
+		return s.q().QueryRowContext(ctx, query, id).Scan(&hash)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, fmt.Errorf("%w with id %d", ErrAccountNotFound, id)
+		}
+		return false, err
+	}
+
+	if !hash.Valid {
+		return false, nil
+	}
+	return comparePIN(hash.String, pin)
+}
+
+// lockedAccount is the part of an account row TransferBatch needs while the row is locked
+type lockedAccount struct {
+	balance    int64
+	currency   string
+	dailyLimit int64 // 0 means no limit
+}
+
+// TransferBatch moves money from fromID to every entry's account in one transaction, all or nothing.
+// Every involved row is locked up front in ascending id order, so two batches touching the same accounts
+// always lock in the same order and can't deadlock each other. Problems with the batch itself (unknown accounts,
+// insufficient funds, ...) are reported in the result with Status "rejected", the error is only for DB failures.
+// a batch with a reference that already completed isn't run again, its stored result comes back with Replayed set
+func (s *PostgresStore) TransferBatch(ctx context.Context, fromID int, entries []TransferEntry, reference, actor string) (_ *TransferBatchResult, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if reference != "" {
+		stored, err := claimReference(ctx, tx, reference, fromID)
+		if err != nil || stored != nil {
+			return stored, err
+		}
+	}
+
+	ids := []int64{int64(fromID)}
+	for _, e := range entries {
+		ids = append(ids, int64(e.ToAccountID))
+	}
+
+	query := `
+		SELECT id, balance, currency, daily_transfer_limit
+		FROM accounts
+		WHERE id = ANY($1)
+		ORDER BY id
+		FOR UPDATE;
+	`
+	rows, err := tx.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	locked := make(map[int]*lockedAccount)
+	for rows.Next() {
+		var id int
+		var balance sql.NullInt64 // a NULL balance counts as 0
+		var acc lockedAccount
+		if err := rows.Scan(&id, &balance, &acc.currency, &acc.dailyLimit); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		acc.balance = balance.Int64
+		locked[id] = &acc
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	source, ok := locked[fromID]
+	if !ok {
+		return nil, fmt.Errorf("%w with id %d", ErrAccountNotFound, fromID)
+	}
+
+	result := &TransferBatchResult{
+		FromAccountID: fromID,
+		Reference:     reference,
+		Status:        "completed",
+		Balance:       source.balance,
+		Results:       make([]TransferResult, len(entries)),
+	}
+
+	// work out every new balance in memory first, nothing is written unless the whole batch is valid
+	balances := map[int]int64{fromID: source.balance}
+	failed := false
+	for i, e := range entries {
+		res := TransferResult{Index: i, ToAccountID: e.ToAccountID, Amount: e.Amount, Status: "ok"}
+
+		dest, ok := locked[e.ToAccountID]
+		switch {
+		case e.Amount <= 0:
+			res.Status, res.Code, res.Error = "failed", CodeInvalidAmount, "amount must be positive"
+		case e.ToAccountID == fromID:
+			res.Status, res.Code, res.Error = "failed", CodeSelfTransfer, "cannot transfer to the source account"
+		case !ok:
+			res.Status, res.Code, res.Error = "failed", CodeAccountNotFound, fmt.Sprintf("no account found with id %d", e.ToAccountID)
+		case dest.currency != source.currency && s.rates == nil:
+			res.Status, res.Code, res.Error = "failed", CodeCurrencyMismatch, fmt.Sprintf("currency mismatch: %s to %s", source.currency, dest.currency)
+		case e.Currency != "" && e.Currency != source.currency && !e.Convert:
+			res.Status, res.Code, res.Error = "failed", CodeCurrencyMismatch,
+				fmt.Sprintf("amount is in %s but account %d holds %s, set convert to have it converted", e.Currency, fromID, source.currency)
+		case e.Currency != "" && e.Currency != source.currency && s.rates == nil:
+			res.Status, res.Code, res.Error = "failed", CodeCurrencyMismatch, fmt.Sprintf("can't convert %s to %s, no exchange rates are configured", e.Currency, source.currency)
+		default:
+			// an amount in another currency (with convert set) is first converted to the source's currency
+			debit := e.Amount
+			if e.Currency != "" && e.Currency != source.currency {
+				rate, err := s.rates.Rate(ctx, e.Currency, source.currency)
+				if errors.Is(err, ErrNoExchangeRate) {
+					res.Status, res.Code, res.Error = "failed", CodeNoExchangeRate, err.Error()
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				if debit, err = convertAmount(e.Amount, e.Currency, source.currency, rate); err != nil {
+					res.Status, res.Code, res.Error = "failed", CodeAmountOverflow, err.Error()
+					break
+				}
+				if debit <= 0 {
+					res.Status, res.Code, res.Error = "failed", CodeInvalidAmount, fmt.Sprintf("amount is 0 once converted to %s", source.currency)
+					break
+				}
+				res.DebitedAmount, res.DebitRate = debit, formatRate(rate)
+			}
+			if result.TotalAmount > math.MaxInt64-debit {
+				res.Status, res.Code, res.Error = "failed", CodeAmountOverflow, "batch total overflows"
+				break
+			}
+
+			// the source is debited in its currency, the destination is credited that converted to its own
+			credit := debit
+			if dest.currency != source.currency {
+				rate, err := s.rates.Rate(ctx, source.currency, dest.currency)
+				if errors.Is(err, ErrNoExchangeRate) {
+					res.Status, res.Code, res.Error = "failed", CodeNoExchangeRate, err.Error()
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				if credit, err = convertAmount(debit, source.currency, dest.currency, rate); err != nil {
+					res.Status, res.Code, res.Error = "failed", CodeAmountOverflow, err.Error()
+					break
+				}
+				res.ConvertedAmount, res.Currency, res.Rate = credit, dest.currency, formatRate(rate)
+			}
+
+			if _, seen := balances[e.ToAccountID]; !seen {
+				balances[e.ToAccountID] = dest.balance
+			}
+			if balances[e.ToAccountID] > math.MaxInt64-credit {
+				res.Status, res.Code, res.Error = "failed", CodeAmountOverflow, "destination balance would overflow"
+				break
+			}
+			balances[e.ToAccountID] += credit
+			result.TotalAmount += debit
+		}
+
+		if res.Status == "failed" {
+			failed = true
+		}
+		result.Results[i] = res
+	}
+
+	if !failed && result.TotalAmount > source.balance {
+		result.Code = CodeInsufficientFunds
+		result.Error = fmt.Sprintf("insufficient funds: batch total %d exceeds balance %d", result.TotalAmount, source.balance)
+		failed = true
+	}
+	if !failed && source.dailyLimit > 0 {
+		// the source row is locked, so no other transfer out of it can sneak in between this sum and the commit
+		spent, err := transferredToday(ctx, tx, fromID)
+		if err != nil {
+			return nil, err
+		}
+		if remaining := max(source.dailyLimit-spent, 0); result.TotalAmount > remaining {
+			result.Code = CodeTransferLimitExceeded
+			result.Error = fmt.Sprintf("daily transfer limit exceeded: batch total %d is over the %d left of today's %d limit", result.TotalAmount, remaining, source.dailyLimit)
+			result.RemainingLimit = &remaining
+			failed = true
+		}
+	}
+	if failed {
+		result.Status = "rejected"
+		if result.Error == "" {
+			result.Code = CodeTransferRejected
+			result.Error = "one or more entries failed, no transfers were made"
+		}
+		for i := range result.Results {
+			if result.Results[i].Status == "ok" {
+				result.Results[i].Status = "skipped"
+			}
+		}
+		return result, nil
+	}
+
+	balances[fromID] -= result.TotalAmount
+
+	// write in the same ascending order the rows were locked in
+	for _, id := range sortedKeys(balances) {
+		if _, err := tx.ExecContext(ctx, `UPDATE accounts SET balance = $1 WHERE id = $2;`, balances[id], id); err != nil {
+			return nil, err
+		}
+		before := map[string]int64{"balance": locked[id].balance}
+		after := map[string]int64{"balance": balances[id]}
+		if err := insertAudit(ctx, tx, id, AuditTransfer, actor, before, after); err != nil {
+			return nil, err
+		}
+		result.Changes = append(result.Changes, BalanceChange{AccountID: id, Previous: locked[id].balance, Current: balances[id]})
+	}
+
+	result.Balance = balances[fromID]
+	if reference != "" {
+		if err := saveReferenceResult(ctx, tx, reference, result); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// transferredToday sums what accountID has sent in transfers since midnight UTC. there's no transactions table,
+// so it's read from the audit log: every transfer leaves a "transfer" entry per account with its balance before
+// and after, and an account is never both source and destination in one batch, so the entries where the
+// balance went down are exactly the ones it sent
+func transferredToday(ctx context.Context, tx querier, accountID int) (int64, error) {
+	query := `
+		SELECT COALESCE(SUM((before->>'balance')::bigint - (after->>'balance')::bigint), 0)
+		FROM audit_log
+		WHERE account_id = $1
+		  AND action = $2
+		  AND at >= date_trunc('day', now() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+		  AND (after->>'balance')::bigint < (before->>'balance')::bigint;
+	`
+	var spent int64
+	err := tx.QueryRowContext(ctx, query, accountID, AuditTransfer).Scan(&spent)
+	return spent, err
+}
+
+// sortedKeys returns the keys of m in ascending order
+func sortedKeys(m map[int]int64) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
 }
@@ -0,0 +1,593 @@
+//go:build integration
+
+package main
+
+// these run against a real Postgres: DATABASE_URL=postgres://... go test -tags integration ./...
+// every test gets its own schema (see DB_SCHEMA), dropped again when it's done
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestPostgresStore returns a PostgresStore set up in a fresh schema of the DATABASE_URL database,
+// or skips the test when DATABASE_URL isn't set
+func newTestPostgresStore(t *testing.T) *PostgresStore {
+	t.Helper()
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+
+	schema := fmt.Sprintf("gobank_test_%d", time.Now().UnixNano())
+	sep := "?"
+	if strings.Contains(dbURL, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("postgres", dbURL+sep+"search_path="+schema+",public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &PostgresStore{db: db, schema: schema, readRetries: defaultReadRetries,
+		retryBackoff: defaultRetryBackoff, queryTimeout: defaultQueryTimeout}
+	t.Cleanup(func() {
+		if _, err := db.Exec(`DROP SCHEMA IF EXISTS ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("drop test schema: %v", err)
+		}
+		db.Close()
+	})
+
+	if err := store.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// mustCreate creates an account with balance, failing the test if it can't
+func mustCreate(t *testing.T, store AccountStore, first string, balance int64) *Account {
+	t.Helper()
+	acc, err := store.CreateAccount(context.Background(),
+		&CreateAccountRequest{FirstName: first, LastName: "test", Currency: defaultCurrency, InitialBalance: balance}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acc
+}
+
+// a failed call inside a TxStore only undoes itself (its savepoint), the transaction goes on and commits the rest
+func TestTxSavepoints(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+	source := mustCreate(t, store, "source", 100)
+
+	tx, err := store.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	created := mustCreate(t, tx, "funded", 0)
+
+	// rejected, insufficient funds
+	result, err := tx.TransferBatch(ctx, source.ID, []TransferEntry{{ToAccountID: created.ID, Amount: 500}}, "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != "rejected" {
+		t.Fatalf("status = %s, want rejected", result.Status)
+	}
+
+	// fails with an error, the transaction has to stay usable
+	if _, err := tx.UpdateAccount(ctx, created.ID+1000, &UpdateAccountRequest{FirstName: "x", LastName: "y"}, "test"); err == nil {
+		t.Fatal("updating a missing account succeeded")
+	}
+
+	if _, err := tx.TransferBatch(ctx, source.ID, []TransferEntry{{ToAccountID: created.ID, Amount: 60}}, "", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// not visible outside before the commit
+	if _, err := store.GetAccountByID(ctx, created.ID); err == nil {
+		t.Fatal("account created in the transaction visible before commit")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := store.GetAccountBalanceByID(ctx, source.ID); b != 40 {
+		t.Fatalf("source balance = %d, want 40", b)
+	}
+	if b, _ := store.GetAccountBalanceByID(ctx, created.ID); b != 60 {
+		t.Fatalf("funded balance = %d, want 60", b)
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+
+	tx, err := store.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := mustCreate(t, tx, "gone", 10)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetAccountByID(ctx, created.ID); err == nil {
+		t.Fatal("account still there after rollback")
+	}
+	if _, err := tx.(TxBeginner).BeginTx(ctx); err != ErrNestedTx {
+		t.Fatalf("nested BeginTx err = %v, want %v", err, ErrNestedTx)
+	}
+}
+
+func TestUpdatedAtTrigger(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+	created := mustCreate(t, store, "stamped", 0)
+
+	time.Sleep(10 * time.Millisecond) // now() has microsecond resolution, make sure the update's is later
+	updated, err := store.UpdateAccount(ctx, created.ID, &UpdateAccountRequest{FirstName: "renamed", LastName: "test"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !updated.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("created_at changed from %v to %v", created.CreatedAt, updated.CreatedAt)
+	}
+	if !updated.UpdatedAt.After(created.UpdatedAt) {
+		t.Errorf("updated_at %v isn't after %v", updated.UpdatedAt, created.UpdatedAt)
+	}
+}
+
+func TestAuditLogImmutable(t *testing.T) {
+	store := newTestPostgresStore(t)
+	mustCreate(t, store, "audited", 0)
+
+	if _, err := store.db.Exec(`UPDATE audit_log SET actor = 'someone else'`); err == nil {
+		t.Error("updating audit_log succeeded")
+	}
+	if _, err := store.db.Exec(`DELETE FROM audit_log`); err == nil {
+		t.Error("deleting from audit_log succeeded")
+	}
+	// the failed statements above mustn't leave a pooled connection in an aborted transaction
+	for range 5 {
+		if _, err := store.GetAuditLog(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// numbers issued before the check digit existed don't pass the Luhn check but still have to be found
+func TestGetAccountByPreCheckDigitNumber(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+	acc := mustCreate(t, store, "legacy", 0)
+	const legacy = 123456 // fails the Luhn check
+	if _, err := store.db.Exec(`UPDATE accounts SET number = $1 WHERE id = $2`, legacy, acc.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := store.GetAccountByNumber(ctx, legacy)
+	if err != nil || found.ID != acc.ID {
+		t.Fatalf("GetAccountByNumber(%d) = %v, %v, want account %d", legacy, found, err, acc.ID)
+	}
+
+	_, err = store.GetAccountByNumber(ctx, 123457)
+	if err == nil || errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("unknown number failing the check: err = %v, want invalid account number", err)
+	}
+	number, _ := withCheckDigit(999999)
+	if _, err := store.GetAccountByNumber(ctx, number); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("unknown valid number: err = %v, want %v", err, ErrAccountNotFound)
+	}
+}
+
+func TestUpdateOmittedBalanceKeepsIt(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+	acc := mustCreate(t, store, "kept", 100)
+
+	updated, err := store.UpdateAccount(ctx, acc.ID, &UpdateAccountRequest{FirstName: "x", LastName: "y"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Balance != 100 {
+		t.Fatalf("balance after an update without one = %d, want 100", updated.Balance)
+	}
+
+	zero := int64(0)
+	updated, err = store.UpdateAccount(ctx, acc.ID, &UpdateAccountRequest{FirstName: "x", LastName: "y", Balance: &zero}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Balance != 0 {
+		t.Fatalf("balance after setting it to 0 = %d", updated.Balance)
+	}
+}
+
+// schemaObjects lists the triggers, indexes, sequences and functions in the store's schema
+func schemaObjects(t *testing.T, store *PostgresStore) []string {
+	t.Helper()
+	rows, err := store.db.Query(`
+		SELECT 'trigger ' || tgname FROM pg_trigger t JOIN pg_class c ON c.oid = t.tgrelid
+			WHERE c.relnamespace = $1::regnamespace AND NOT t.tgisinternal
+		UNION ALL SELECT 'index ' || indexname FROM pg_indexes WHERE schemaname = $1
+		UNION ALL SELECT 'sequence ' || sequencename FROM pg_sequences WHERE schemaname = $1
+		UNION ALL SELECT 'function ' || proname FROM pg_proc WHERE pronamespace = $1::regnamespace
+		ORDER BY 1`, store.schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var objects []string
+	for rows.Next() {
+		var o string
+		if err := rows.Scan(&o); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, o)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+func TestSetupTwice(t *testing.T) {
+	store := newTestPostgresStore(t) // runs Setup once
+	acc := mustCreate(t, store, "survivor", 42)
+	before := schemaObjects(t, store)
+
+	if err := store.Setup(); err != nil {
+		t.Fatalf("second Setup: %v", err)
+	}
+
+	if after := schemaObjects(t, store); strings.Join(after, "\n") != strings.Join(before, "\n") {
+		t.Fatalf("schema objects changed\nbefore: %v\nafter:  %v", before, after)
+	}
+	if got, err := store.GetAccountByID(context.Background(), acc.ID); err != nil || got.Balance != 42 {
+		t.Fatalf("account after the second Setup: %v, %v", got, err)
+	}
+}
+
+func TestParallelCreatesGetUniqueNumbers(t *testing.T) {
+	store := newTestPostgresStore(t)
+
+	const n = 50
+	numbers := make(chan int64, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acc, err := store.CreateAccount(context.Background(),
+				&CreateAccountRequest{FirstName: fmt.Sprintf("p%d", i), LastName: "test", Currency: defaultCurrency}, "test")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			numbers <- acc.Number
+		}()
+	}
+	wg.Wait()
+	close(numbers)
+
+	seen := map[int64]bool{}
+	for number := range numbers {
+		if seen[number] {
+			t.Errorf("number %d handed out twice", number)
+		}
+		if !ValidateAccountNumber(number) {
+			t.Errorf("number %d fails the Luhn check", number)
+		}
+		seen[number] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("%d unique numbers, want %d", len(seen), n)
+	}
+}
+
+// the sequence is set back so the next values collide with numbers already handed out, like after a restore
+// that reset it. creates have to retry past the duplicates instead of failing
+func TestCreateRetriesDuplicateNumbers(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+	for i := range 4 {
+		mustCreate(t, store, fmt.Sprintf("first%d", i), 0)
+	}
+	if _, err := store.db.Exec(`SELECT setval('` + accountNumberSequence + `', 2)`); err != nil {
+		t.Fatal(err)
+	}
+
+	// values 3 and 4 are taken, so at most 2 duplicates before 5: within maxCreateAttempts
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.CreateAccount(ctx, &CreateAccountRequest{FirstName: fmt.Sprintf("second%d", i), LastName: "test",
+				Currency: defaultCurrency}, "test"); err != nil {
+				t.Errorf("create after the sequence reset: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var dups int
+	if err := store.db.QueryRow(`SELECT count(*) - count(DISTINCT number) FROM accounts`).Scan(&dups); err != nil {
+		t.Fatal(err)
+	}
+	if dups != 0 {
+		t.Fatalf("%d duplicate numbers", dups)
+	}
+}
+
+func TestUpdateMissingAndUpsert(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+	req := &UpdateAccountRequest{FirstName: "x", LastName: "y"}
+
+	if _, err := store.UpdateAccount(ctx, 500, req, "test"); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("update of a missing id: err = %v, want %v", err, ErrAccountNotFound)
+	}
+
+	acc, created, err := store.UpsertAccount(ctx, 500, req, "test")
+	if err != nil || !created || acc.ID != 500 {
+		t.Fatalf("first upsert = %v, %v, %v, want account 500 created", acc, created, err)
+	}
+	req.FirstName = "z"
+	acc, created, err = store.UpsertAccount(ctx, 500, req, "test")
+	if err != nil || created || acc.FirstName != "z" {
+		t.Fatalf("second upsert = %v, %v, %v, want account 500 updated", acc, created, err)
+	}
+
+	// creating normally afterwards still works
+	mustCreate(t, store, "after", 0)
+}
+
+func TestNullColumns(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+
+	var id int
+	err := store.db.QueryRow(`
+		INSERT INTO accounts (first_name, last_name, balance, created_at, updated_at)
+		VALUES (NULL, NULL, NULL, NULL, NULL) RETURNING id`).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err := store.GetAccountByID(ctx, id)
+	if err != nil {
+		t.Fatalf("GetAccountByID on a row of NULLs: %v", err)
+	}
+	if acc.FirstName != "" || acc.LastName != "" || acc.Balance != 0 || !acc.CreatedAt.IsZero() || !acc.UpdatedAt.IsZero() {
+		t.Fatalf("NULLs didn't read as zero values: %+v", acc)
+	}
+
+	if balance, err := store.GetAccountBalanceByID(ctx, id); err != nil || balance != 0 {
+		t.Fatalf("GetAccountBalanceByID = %d, %v", balance, err)
+	}
+	accounts, _, err := store.ListAccounts(ctx, AccountFilter{}, 10, 0)
+	if err != nil || len(accounts) != 1 {
+		t.Fatalf("ListAccounts = %v, %v", accounts, err)
+	}
+	if _, err := store.GetAccountByNumber(ctx, acc.Number); err != nil {
+		t.Fatalf("GetAccountByNumber: %v", err)
+	}
+}
+
+// the store rejects what the handler already checks too, for callers that skip the handler
+func TestTransferGuardsInStore(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+	a, b := mustCreate(t, store, "a", 100), mustCreate(t, store, "b", 0)
+
+	for _, e := range []TransferEntry{{ToAccountID: a.ID, Amount: 10}, {ToAccountID: b.ID, Amount: 0}, {ToAccountID: b.ID, Amount: -1}} {
+		result, err := store.TransferBatch(ctx, a.ID, []TransferEntry{e}, "", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status == "completed" {
+			t.Errorf("transfer %+v went through", e)
+		}
+	}
+	if balance, _ := store.GetAccountBalanceByID(ctx, a.ID); balance != 100 {
+		t.Fatalf("balance = %d after rejected transfers, want 100", balance)
+	}
+}
+
+// retries with the same reference, one after the other or at the same time, move the money once and all get
+// the first batch's result
+func TestTransferReferenceInStore(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+	a, b, c := mustCreate(t, store, "a", 100), mustCreate(t, store, "b", 0), mustCreate(t, store, "c", 100)
+	entries := []TransferEntry{{ToAccountID: b.ID, Amount: 10}}
+
+	var wg sync.WaitGroup
+	results := make([]*TransferBatchResult, 5)
+	errs := make([]error, len(results))
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = store.TransferBatch(ctx, a.ID, entries, "ref-1", "test")
+		}()
+	}
+	wg.Wait()
+
+	replayed := 0
+	for i, result := range results {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if result.Status != "completed" || result.Reference != "ref-1" || result.Balance != 90 {
+			t.Fatalf("result %d = %+v, want the completed batch", i, result)
+		}
+		if result.Replayed {
+			replayed++
+		}
+	}
+	if replayed != len(results)-1 {
+		t.Fatalf("%d results replayed, want all but one", replayed)
+	}
+	if balance, _ := store.GetAccountBalanceByID(ctx, b.ID); balance != 10 {
+		t.Fatalf("destination balance = %d, want 10", balance)
+	}
+
+	if _, err := store.TransferBatch(ctx, c.ID, entries, "ref-1", "test"); !errors.Is(err, ErrReferenceInUse) {
+		t.Fatalf("reference reused by another account: err = %v, want ErrReferenceInUse", err)
+	}
+
+	// a rejected batch rolls its reference back with everything else
+	if result, err := store.TransferBatch(ctx, a.ID, []TransferEntry{{ToAccountID: b.ID, Amount: 1000}}, "ref-2", "test"); err != nil || result.Status != "rejected" {
+		t.Fatalf("TransferBatch = %+v, %v, want rejected", result, err)
+	}
+	if result, err := store.TransferBatch(ctx, a.ID, entries, "ref-2", "test"); err != nil || result.Replayed || result.Balance != 80 {
+		t.Fatalf("TransferBatch = %+v, %v, want a new batch", result, err)
+	}
+}
+
+// timestamps come back in UTC (and marshal with a Z) whatever zone the database session and this process are in
+func TestTimestampsInUTC(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.FixedZone("UTC-7", -7*60*60)
+	store.db.SetMaxOpenConns(1) // so the SET below holds for every query
+	if _, err := store.db.Exec(`SET TIME ZONE 'Asia/Tokyo'`); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	created := mustCreate(t, store, "utc", 0)
+	acc, err := store.GetAccountByID(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ts := range map[string]time.Time{"createdAt": acc.CreatedAt, "updatedAt": acc.UpdatedAt, "created": created.CreatedAt} {
+		if ts.Location() != time.UTC {
+			t.Errorf("%s is in %v, want UTC", name, ts.Location())
+		}
+		if d := ts.Sub(before); d < -time.Minute || d > time.Minute {
+			t.Errorf("%s = %v is %v off from now, the zone was applied twice", name, ts, d)
+		}
+	}
+
+	body, err := json.Marshal(toAccountResponse(acc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"createdAt":"` + acc.CreatedAt.Format(time.RFC3339Nano) + `"`; !strings.Contains(string(body), want) || !strings.HasSuffix(acc.CreatedAt.Format(time.RFC3339), "Z") {
+		t.Fatalf("JSON %s doesn't have %s", body, want)
+	}
+}
+
+// a NULL last name and an empty one read the same, so they're one group in the report
+func TestGroupedBalancesMergesNullAndEmpty(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+
+	_, err := store.db.Exec(`
+		INSERT INTO accounts (first_name, last_name, balance, created_at, updated_at)
+		VALUES ('a', NULL, 10, now(), now()), ('b', '', 20, now(), now())`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, store, "c", 5)
+
+	groups, err := store.GroupedBalances(ctx, "lastName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []GroupRow{{Group: "", Count: 2, TotalBalance: 30}, {Group: "test", Count: 1, TotalBalance: 5}}
+	if fmt.Sprint(groups) != fmt.Sprint(want) {
+		t.Fatalf("groups = %+v, want %+v", groups, want)
+	}
+}
+
+// a statement is built from the audit log: the account's create entry and its transfers, with the balance
+// running from the opening balance to the closing one
+func TestStatement(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+	start := time.Now().Add(-time.Minute)
+	a, b := mustCreate(t, store, "a", 100), mustCreate(t, store, "b", 0)
+
+	for _, amount := range []int64{30, 20} {
+		if result, err := store.TransferBatch(ctx, a.ID, []TransferEntry{{ToAccountID: b.ID, Amount: amount}}, "", "test"); err != nil || result.Status != "completed" {
+			t.Fatalf("transfer: %+v, %v", result, err)
+		}
+	}
+	// a rename doesn't move the balance, it's left off
+	if _, err := store.UpdateAccount(ctx, a.ID, &UpdateAccountRequest{FirstName: "renamed", LastName: "test"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	statement, err := store.GetStatement(ctx, a.ID, start, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statement.OpeningBalance != 0 || statement.ClosingBalance != 50 {
+		t.Fatalf("opening %d, closing %d, want 0 and 50", statement.OpeningBalance, statement.ClosingBalance)
+	}
+	if statement.Summary != (TransactionSummary{Credits: 100, Debits: 50, Net: 50}) {
+		t.Fatalf("summary = %+v, want 100 in, 50 out", statement.Summary)
+	}
+	var amounts []int64
+	for _, e := range statement.Entries {
+		amounts = append(amounts, e.Amount)
+	}
+	if fmt.Sprint(amounts) != "[100 -30 -20]" {
+		t.Fatalf("amounts = %v, want [100 -30 -20]", amounts)
+	}
+
+	// starting after everything happened, nothing is on it and the balance doesn't move
+	statement, err = store.GetStatement(ctx, a.ID, time.Now().Add(time.Minute), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statement.OpeningBalance != 50 || statement.ClosingBalance != 50 || len(statement.Entries) != 0 {
+		t.Fatalf("got %+v, want a flat statement at 50", statement)
+	}
+
+	if _, err := store.GetStatement(ctx, 0, start, time.Now()); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("missing account: %v, want ErrAccountNotFound", err)
+	}
+}
+
+// funding a EUR account from a USD one converts the amount instead of failing the currency check
+func TestCreateFundedAccountAcrossCurrencies(t *testing.T) {
+	ctx := context.Background()
+	store := newTestPostgresStore(t)
+	rates, err := ParseExchangeRates("EUR/USD=2,USD/EUR=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.rates = rates
+	source := mustCreate(t, store, "source", 1000)
+	h := newTestServer(store, nil).routes()
+
+	body := fmt.Sprintf(`{"firstName":"c","lastName":"d","currency":"EUR","funding":{"fromAccountID":%d,"amount":100}}`, source.ID)
+	rec := serve(h, "POST", "/v1/account", body)
+	if rec.Code != 201 || !strings.Contains(rec.Body.String(), `"balance":100`) {
+		t.Fatalf("status %d, body %s, want 201 with a balance of 100", rec.Code, rec.Body)
+	}
+	if balance, _ := store.GetAccountBalanceByID(ctx, source.ID); balance != 800 {
+		t.Fatalf("source balance = %d, want 1000 - 100 EUR at 2 = 800", balance)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nullRow is a row where every nullable column is NULL. the NOT NULL ones (id, number, currency) get fixed values
+type nullRow struct{}
+
+func (nullRow) Scan(dest ...any) error {
+	for i, d := range dest {
+		switch d := d.(type) {
+		case sql.Scanner:
+			if err := d.Scan(nil); err != nil {
+				return err
+			}
+		case *int:
+			*d = 7
+		case *int64:
+			*d = 79
+		case *string:
+			*d = "EUR"
+		default:
+			return fmt.Errorf("column %d: can't scan NULL into %T", i, d)
+		}
+	}
+	return nil
+}
+
+func TestScanAccountNulls(t *testing.T) {
+	acc := Account{FirstName: "stale", Balance: 5, CreatedAt: time.Now()}
+	if err := scanAccount(nullRow{}, &acc); err != nil {
+		t.Fatal(err)
+	}
+	want := Account{ID: 7, Number: 79, Currency: "EUR"}
+	if acc != want {
+		t.Fatalf("got %+v, want %+v", acc, want)
+	}
+}
+
+func TestNullTimeUTC(t *testing.T) {
+	if got := nullTimeUTC(sql.NullTime{}); !got.IsZero() {
+		t.Fatalf("NULL gave %v", got)
+	}
+	local := time.Date(2024, 1, 31, 10, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+	got := nullTimeUTC(sql.NullTime{Time: local, Valid: true})
+	if got.Location() != time.UTC || !got.Equal(local) {
+		t.Fatalf("got %v, want %v in UTC", got, local)
+	}
+}
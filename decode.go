@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// maxBodyBytes caps how much of a request body we'll read, our biggest bodies (transfer batches) are well under this
+const maxBodyBytes = 1 << 20 // 1 MiB
+
+// decodeJSON decodes the request body into a new T. It's strict about what it accepts:
+// unknown fields, bodies over maxBodyBytes and anything after the first JSON value are all rejected.
+// every failure comes back as a statusError (400, or 413 for oversized bodies) with a specific message
+func decodeJSON[T any](req *http.Request) (*T, error) {
+	raw, err := io.ReadAll(http.MaxBytesReader(nil, req.Body, maxBodyBytes))
+	if err != nil {
+		return nil, describeDecodeError(err)
+	}
+
+	// no body at all and a bare null are the same mistake, null would otherwise decode into an empty T
+	// and come back as a pile of "is required" validation errors
+	switch trimmed := bytes.TrimSpace(raw); {
+	case len(trimmed) == 0:
+		return nil, newCodedError(http.StatusBadRequest, CodeBodyRequired, "request body is required")
+	case string(trimmed) == "null":
+		return nil, newCodedError(http.StatusBadRequest, CodeBodyRequired, "request body is required, got null")
+	}
+
+	if snakeCaseJSON {
+		// snake_case keys become the camelCase ones T knows. a body renameKeys can't parse is decoded as sent,
+		// so the client gets the same error message it would have without snake_case
+		if renamed, err := renameKeys(raw, snakeToCamel); err == nil {
+			raw = renamed
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+
+	var v T
+	if err := dec.Decode(&v); err != nil {
+		// the client gets the details in the 400, this is only for debugging
+		slog.Debug("failed to decode request body", "method", req.Method, "path", req.URL.Path, "error", err)
+		return nil, describeDecodeError(err)
+	}
+
+	// a second value (or garbage) after the first means the body isn't what the client thinks it is
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return nil, newCodedError(http.StatusBadRequest, CodeInvalidJSON, "request body must contain a single JSON value")
+	}
+
+	return &v, nil
+}
+
+// describeDecodeError turns a JSON decode error into a message that tells the client what's actually wrong with the body
+func describeDecodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return newCodedError(http.StatusBadRequest, CodeInvalidJSON, "empty body")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return newCodedError(http.StatusBadRequest, CodeInvalidJSON, "malformed JSON: body ended unexpectedly")
+	case errors.As(err, &syntaxErr):
+		return newCodedError(http.StatusBadRequest, CodeInvalidJSON, "malformed JSON at byte offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr) && strings.HasPrefix(typeErr.Value, "number ") && isIntKind(typeErr.Type.Kind()):
+		return describeBadInteger(typeErr)
+	case errors.As(err, &typeErr):
+		return newCodedError(http.StatusBadRequest, CodeInvalidJSON, "invalid value for field %q: expected %s", typeErr.Field, typeErr.Type)
+	case errors.As(err, &maxBytesErr):
+		return newStatusError(http.StatusRequestEntityTooLarge, "request body must not be larger than %d bytes", maxBytesErr.Limit)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json doesn't export a type for this one, so match the message
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		if name, err := strconv.Unquote(field); err == nil && snakeCaseJSON {
+			field = strconv.Quote(camelToSnake(name)) // name it the way the client sent it
+		}
+		return newCodedError(http.StatusBadRequest, CodeUnknownField, "unknown field %s", field)
+	default:
+		return newCodedError(http.StatusBadRequest, CodeInvalidJSON, "invalid request body")
+	}
+}
+
+// describeBadInteger explains why a JSON number didn't fit an integer field: it's either too big (or small)
+// for the field's type, or it isn't a whole number at all
+func describeBadInteger(typeErr *json.UnmarshalTypeError) error {
+	literal := strings.TrimPrefix(typeErr.Value, "number ")
+	if r, ok := new(big.Rat).SetString(literal); !ok || !r.IsInt() {
+		return newCodedError(http.StatusBadRequest, CodeInvalidJSON, "value %s for field %q must be a whole number", literal, typeErr.Field)
+	}
+
+	bits := typeErr.Type.Bits()
+	lo, hi := new(big.Int), new(big.Int).Lsh(big.NewInt(1), uint(bits)) // unsigned: [0, 2^bits)
+	if typeErr.Type.Kind() >= reflect.Int && typeErr.Type.Kind() <= reflect.Int64 {
+		hi.Rsh(hi, 1) // signed: [-2^(bits-1), 2^(bits-1))
+		lo.Neg(hi)
+	}
+	hi.Sub(hi, big.NewInt(1))
+	return newCodedError(http.StatusBadRequest, CodeOutOfRange, "value %s for field %q is out of range, it must be between %s and %s",
+		literal, typeErr.Field, lo, hi)
+}
+
+func isIntKind(k reflect.Kind) bool {
+	return (k >= reflect.Int && k <= reflect.Int64) || (k >= reflect.Uint && k <= reflect.Uint64)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBadIntegerInBody(t *testing.T) {
+	admin := []string{adminTokenHeader, "secret"}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   []string
+	}{
+		{"balance too big", http.MethodPost, "/v1/account", `{"firstName":"a","lastName":"b","initialBalance":99999999999999999999}`,
+			[]string{`"code":"OUT_OF_RANGE"`, `between -9223372036854775808 and 9223372036854775807`}},
+		{"balance too small", http.MethodPost, "/v1/account", `{"firstName":"a","lastName":"b","initialBalance":-99999999999999999999}`,
+			[]string{`"code":"OUT_OF_RANGE"`}},
+		{"balance with a fraction", http.MethodPost, "/v1/account", `{"firstName":"a","lastName":"b","initialBalance":1.5}`,
+			[]string{`"code":"INVALID_JSON"`, `must be a whole number`}},
+		{"balance in an exponent", http.MethodPost, "/v1/account", `{"firstName":"a","lastName":"b","initialBalance":1e30}`,
+			[]string{`"code":"OUT_OF_RANGE"`}},
+		{"PUT balance too big", http.MethodPut, "/v1/account/1", `{"firstName":"a","lastName":"b","balance":99999999999999999999}`,
+			[]string{`"code":"OUT_OF_RANGE"`}},
+		{"transfer amount too big", http.MethodPost, "/v1/account/1/transfer-batch", `[{"toAccountID":2,"amount":99999999999999999999}]`,
+			[]string{`"code":"OUT_OF_RANGE"`}},
+		{"account id too big", http.MethodPost, "/v1/account/1/transfer-batch", `[{"toAccountID":99999999999999999999,"amount":1}]`,
+			[]string{`"code":"OUT_OF_RANGE"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b"}), &Config{AdminToken: "secret"}).routes()
+			wantResponse(t, serve(h, tt.method, tt.path, tt.body, admin...), http.StatusBadRequest, tt.want...)
+		})
+	}
+}
+
+func TestMissingBody(t *testing.T) {
+	patch := []string{"Content-Type", mergePatchContentType}
+	for _, body := range []string{"", "   ", "\n\t\r\n", "null", "  null\n"} {
+		for _, r := range []struct {
+			method, path string
+			hdr          []string
+		}{
+			{http.MethodPost, "/v1/account", nil},
+			{http.MethodPut, "/v1/account/1", nil},
+			{http.MethodPatch, "/v1/account/1", patch},
+			{http.MethodPost, "/v1/account/1/transfer-batch", nil},
+		} {
+			t.Run(r.method+" "+r.path+" "+body, func(t *testing.T) {
+				h := newTestServer(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b"}), nil).routes()
+				wantResponse(t, serve(h, r.method, r.path, body, r.hdr...), http.StatusBadRequest, `"code":"BODY_REQUIRED"`)
+			})
+		}
+	}
+}
+
+// null inside the body is a value like any other, only a body that is nothing but null is missing
+func TestNullFieldIsNotMissingBody(t *testing.T) {
+	h := newTestServer(newMemStore(), nil).routes()
+	rec := serve(h, http.MethodPost, "/v1/account", `{"firstName":"a","lastName":"b","currency":null}`)
+	wantResponse(t, rec, http.StatusCreated)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+// ErrorCode is a stable, machine readable identifier sent as "code" next to the human readable "error".
+// clients should branch on these, the messages can change at any time. the full list is in the README
+type ErrorCode string
+
+const (
+	CodeBadRequest       ErrorCode = "BAD_REQUEST"
+	CodeInvalidJSON      ErrorCode = "INVALID_JSON"
+	CodeBodyRequired     ErrorCode = "BODY_REQUIRED"
+	CodeUnknownField     ErrorCode = "UNKNOWN_FIELD"
+	CodeOutOfRange       ErrorCode = "OUT_OF_RANGE"
+	CodePayloadTooLarge  ErrorCode = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedMedia ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	CodeValidationFailed ErrorCode = "VALIDATION_FAILED"
+	CodeUnauthorized     ErrorCode = "UNAUTHORIZED"
+	CodeForbidden        ErrorCode = "FORBIDDEN"
+	CodeNotFound         ErrorCode = "NOT_FOUND"
+	CodeAccountNotFound  ErrorCode = "ACCOUNT_NOT_FOUND"
+	CodeMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeConflict         ErrorCode = "CONFLICT"
+	CodeGone             ErrorCode = "GONE"
+	CodeTimeout          ErrorCode = "TIMEOUT"
+	CodeUnavailable      ErrorCode = "SERVICE_UNAVAILABLE"
+	CodeInternal         ErrorCode = "INTERNAL_ERROR"
+
+	// throttled, retry after the Retry-After header's delay
+	CodeTooManyRequests ErrorCode = "TOO_MANY_REQUESTS"
+
+	// account and transfer rules
+	CodeUnsupportedCurrency ErrorCode = "UNSUPPORTED_CURRENCY"
+	CodeCurrencyMismatch    ErrorCode = "CURRENCY_MISMATCH"
+	CodeNoExchangeRate      ErrorCode = "NO_EXCHANGE_RATE"
+	CodeInvalidAmount       ErrorCode = "INVALID_AMOUNT"
+	CodeSelfTransfer        ErrorCode = "SELF_TRANSFER"
+	CodeAmountOverflow      ErrorCode = "AMOUNT_OVERFLOW"
+	CodeInsufficientFunds   ErrorCode = "INSUFFICIENT_FUNDS"
+	CodeTransferRejected    ErrorCode = "TRANSFER_REJECTED"
+
+	// deletes of accounts with money or history need confirming
+	CodeConfirmationRequired ErrorCode = "CONFIRMATION_REQUIRED"
+
+	// transfers over the source account's daily_transfer_limit
+	CodeTransferLimitExceeded ErrorCode = "TRANSFER_LIMIT_EXCEEDED"
+
+	// another account has the name, with ENFORCE_UNIQUE_NAMES on
+	CodeDuplicateName ErrorCode = "DUPLICATE_NAME"
+
+	// a transfer batch reference that another account's batch already used
+	CodeReferenceInUse ErrorCode = "REFERENCE_IN_USE"
+)
+
+// codeForStatus is the code a statusError gets when it isn't given a more specific one
+func codeForStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusGone:
+		return CodeGone
+	case http.StatusGatewayTimeout:
+		return CodeTimeout
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	case http.StatusInternalServerError:
+		return CodeInternal
+	case http.StatusTooManyRequests:
+		return CodeTooManyRequests
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMedia
+	case http.StatusUnprocessableEntity:
+		return CodeValidationFailed
+	default:
+		return CodeBadRequest
+	}
+}
+
+// errorCode works out the code for any error a handler returns
+func errorCode(err error) ErrorCode {
+	var statusErr *statusError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.Code
+	case errors.Is(err, ErrAccountNotFound):
+		return CodeAccountNotFound
+	case errors.Is(err, ErrDuplicateName):
+		return CodeDuplicateName
+	case errors.Is(err, ErrReferenceInUse):
+		return CodeReferenceInUse
+	case errors.Is(err, ErrQueryTimeout):
+		return CodeTimeout
+	case errors.Is(err, ErrDatabaseUnavailable):
+		return CodeUnavailable
+	case isConflictError(err):
+		return CodeConflict
+	case isInternalError(err):
+		return CodeInternal
+	default:
+		return CodeBadRequest
+	}
+}
+
+// isInternalError reports whether err is a failure on our side rather than something wrong with the request:
+// a database or connection error that nothing above turned into a more specific one. handlers' own errors are
+// statusErrors or plain fmt.Errorf messages about the request, neither of which match
+func isInternalError(err error) bool {
+	var pqErr *pq.Error
+	var netErr net.Error
+	switch {
+	case errors.As(err, &pqErr), errors.As(err, &netErr):
+		return true
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.Is(err, sql.ErrTxDone):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF): // the connection to Postgres dropped
+		return true
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// failingStore fails every GetAccountByID with err
+type failingStore struct {
+	*memStore
+	err error
+}
+
+func (f failingStore) GetAccountByID(context.Context, int) (*Account, error) {
+	return nil, f.err
+}
+
+func TestErrorStatus(t *testing.T) {
+	missingTable := &pq.Error{Code: "42P01", Message: `relation "accounts" does not exist`}
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   ErrorCode
+	}{
+		{"database error", missingTable, http.StatusInternalServerError, CodeInternal},
+		{"wrapped database error", fmt.Errorf("get account: %w", missingTable), http.StatusInternalServerError, CodeInternal},
+		{"connection gone", sql.ErrConnDone, http.StatusInternalServerError, CodeInternal},
+		{"conflict", &pq.Error{Code: "40001"}, http.StatusConflict, CodeConflict},
+		{"not found", fmt.Errorf("%w with id 1", ErrAccountNotFound), http.StatusNotFound, CodeAccountNotFound},
+		{"timeout", fmt.Errorf("%w: %v", ErrQueryTimeout, missingTable), http.StatusGatewayTimeout, CodeTimeout},
+		{"unavailable", ErrDatabaseUnavailable, http.StatusServiceUnavailable, CodeUnavailable},
+		{"plain message about the request", errors.New("invalid mode \"x\""), http.StatusBadRequest, CodeBadRequest},
+		{"status error", newStatusError(http.StatusTeapot, "short and stout"), http.StatusTeapot, CodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+			h := newTestServer(failingStore{newMemStore(), tt.err}, nil).routes()
+			rec := serve(h, http.MethodGet, "/v1/account/1", "")
+			wantResponse(t, rec, tt.status, `"code":"`+string(tt.code)+`"`)
+
+			if tt.code == CodeInternal {
+				if strings.Contains(rec.Body.String(), "relation") || strings.Contains(rec.Body.String(), "connection") {
+					t.Fatalf("the response leaks the real error: %s", rec.Body)
+				}
+				if !strings.Contains(logs.String(), "level=ERROR") || !strings.Contains(logs.String(), `msg="internal error"`) {
+					t.Fatalf("the real error wasn't logged:\n%s", logs.String())
+				}
+			}
+		})
+	}
+}
+
+func TestInternalErrorIsLocalized(t *testing.T) {
+	h := newTestServer(failingStore{newMemStore(), &pq.Error{Code: "XX000"}}, nil).routes()
+	rec := serve(h, http.MethodGet, "/v1/account/1", "", "Accept-Language", "es")
+	wantResponse(t, rec, http.StatusInternalServerError, "error interno del servidor")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// account lifecycle event types
+const (
+	EventAccountCreated = "account.created"
+	EventAccountUpdated = "account.updated"
+	EventAccountDeleted = "account.deleted"
+	EventBalanceChanged = "balance.changed"
+)
+
+// AccountEvent is published on the bus after a store write succeeds
+type AccountEvent struct {
+	Type      string
+	AccountID int
+	At        time.Time
+	Data      any // event specific payload, ex. the AccountResponse for created/updated
+}
+
+// BalanceChangedData is the payload of a balance.changed event
+type BalanceChangedData struct {
+	PreviousBalance int64 `json:"previousBalance"`
+	Balance         int64 `json:"balance"`
+}
+
+// EventBus is a small in-process publish/subscribe registry. Subscribers (webhooks, audit log, ...) register at
+// startup so handlers only have to publish and don't need to know who's listening.
+// Publish calls every subscriber synchronously on the publishing goroutine, so subscribers must not block
+// (hand the event off to a channel/worker if there's real work to do)
+type EventBus[E any] struct {
+	mu     sync.RWMutex
+	nextID int
+	subs   map[int]func(E)
+}
+
+// NewEventBus creates an empty bus
+func NewEventBus[E any]() *EventBus[E] {
+	return &EventBus[E]{subs: make(map[int]func(E))}
+}
+
+// Subscribe registers fn to receive every event published from now on. Call the returned func to unsubscribe
+func (b *EventBus[E]) Subscribe(fn func(E)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = fn
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+// Publish delivers evt to every current subscriber. Publishing on a nil bus is a no-op
+func (b *EventBus[E]) Publish(evt E) {
+	if b == nil {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.subs {
+		fn(evt)
+	}
+}
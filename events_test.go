@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus[int]()
+	var a, b []int
+	unsubA := bus.Subscribe(func(e int) { a = append(a, e) })
+	bus.Subscribe(func(e int) { b = append(b, e) })
+
+	bus.Publish(1)
+	unsubA()
+	unsubA() // twice is harmless
+	bus.Publish(2)
+
+	if !slices.Equal(a, []int{1}) || !slices.Equal(b, []int{1, 2}) {
+		t.Fatalf("a got %v, b got %v", a, b)
+	}
+
+	var nilBus *EventBus[int]
+	nilBus.Publish(3) // no-op, not a panic
+}
+
+func TestEventBusConcurrent(t *testing.T) {
+	bus := NewEventBus[int]()
+	var mu sync.Mutex
+	total := 0
+	bus.Subscribe(func(e int) {
+		mu.Lock()
+		total += e
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			bus.Publish(1)
+		}()
+		go func() {
+			defer wg.Done()
+			bus.Subscribe(func(int) {})()
+		}()
+	}
+	wg.Wait()
+	if total != 50 {
+		t.Fatalf("got %d events, want 50", total)
+	}
+}
+
+// events go out after the store call succeeded, and a failed one publishes nothing
+func TestHandlersPublishEvents(t *testing.T) {
+	store := newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 100})
+	s := newTestServer(store, &Config{AdminToken: "secret"})
+	var got []string
+	s.events.Subscribe(func(e AccountEvent) { got = append(got, e.Type) })
+	h := s.routes()
+
+	serve(h, http.MethodPost, "/v1/account", `{"firstName":"c","lastName":"d"}`)
+	serve(h, http.MethodPut, "/v1/account/1", `{"firstName":"x","lastName":"y","balance":50}`, adminTokenHeader, "secret")
+	serve(h, http.MethodPost, "/v1/account/1/transfer-batch", `[{"toAccountID":2,"amount":20}]`)
+	serve(h, http.MethodDelete, "/v1/account/2?force=true", "")
+	serve(h, http.MethodDelete, "/v1/account/9", "") // fails, no event
+	serve(h, http.MethodPut, "/v1/account/9", `{"firstName":"x","lastName":"y"}`)
+
+	want := []string{
+		EventAccountCreated,
+		EventAccountUpdated, EventBalanceChanged,
+		EventBalanceChanged, EventBalanceChanged,
+		EventAccountDeleted,
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("events %v, want %v", got, want)
+	}
+}
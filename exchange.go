@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ErrNoExchangeRate is returned by an ExchangeRateProvider that can't convert between two currencies
+var ErrNoExchangeRate = errors.New("no exchange rate")
+
+// ExchangeRateProvider supplies the rates cross-currency transfers are converted with
+type ExchangeRateProvider interface {
+	// Rate returns how much one major unit of from is worth in to (ex. USD -> EUR 0.92), or ErrNoExchangeRate
+	Rate(ctx context.Context, from, to string) (*big.Rat, error)
+}
+
+// StaticExchangeRates is an ExchangeRateProvider backed by fixed rates from the config (EXCHANGE_RATES).
+// rates only apply in the direction they're given, USD/EUR doesn't imply EUR/USD
+type StaticExchangeRates map[string]*big.Rat // keyed by "FROM/TO"
+
+// ParseExchangeRates parses a comma separated list like "USD/EUR=0.92,EUR/USD=1.087"
+func ParseExchangeRates(v string) (StaticExchangeRates, error) {
+	rates := StaticExchangeRates{}
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		pair, value, ok := strings.Cut(part, "=")
+		from, to, ok2 := strings.Cut(strings.ToUpper(strings.TrimSpace(pair)), "/")
+		rate, ok3 := new(big.Rat).SetString(strings.TrimSpace(value))
+		if !ok || !ok2 || !ok3 || rate.Sign() <= 0 || len(from) != 3 || len(to) != 3 {
+			return nil, fmt.Errorf("invalid EXCHANGE_RATES entry %q, expected FROM/TO=rate", part)
+		}
+		rates[from+"/"+to] = rate
+	}
+	return rates, nil
+}
+
+func (r StaticExchangeRates) Rate(_ context.Context, from, to string) (*big.Rat, error) {
+	rate, ok := r[from+"/"+to]
+	if !ok {
+		return nil, fmt.Errorf("%w from %s to %s", ErrNoExchangeRate, from, to)
+	}
+	return rate, nil
+}
+
+// convertAmount converts amount (minor units of from) into minor units of to, rounding half up.
+// the rate is per major unit, so the currencies' decimals are accounted for (ex. 100 USD cents -> JPY at 150 = 150)
+func convertAmount(amount int64, from, to string, rate *big.Rat) (int64, error) {
+	converted := new(big.Rat).SetInt64(amount)
+	converted.Mul(converted, rate)
+	converted.Mul(converted, new(big.Rat).SetFrac(pow10(currencyDecimals(to)), pow10(currencyDecimals(from))))
+
+	// round half up: floor(x + 1/2), amounts here are always positive
+	converted.Add(converted, big.NewRat(1, 2))
+	result := new(big.Int).Quo(converted.Num(), converted.Denom())
+	if !result.IsInt64() {
+		return 0, fmt.Errorf("converted amount overflows")
+	}
+	return result.Int64(), nil
+}
+
+// formatRate renders a rate for responses without trailing zeros (ex. 0.92, not 0.92000000)
+func formatRate(rate *big.Rat) string {
+	s := rate.FloatString(8)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccountFilter narrows down ListAccounts. zero value fields don't filter anything
+type AccountFilter struct {
+	CreatedAfter  *time.Time // created_at >= CreatedAfter
+	CreatedBefore *time.Time // created_at < CreatedBefore
+	MinBalance    *int64     // balance >= MinBalance
+	MaxBalance    *int64     // balance <= MaxBalance
+}
+
+// where builds the WHERE clause for the filter (empty when nothing is set). its placeholders start at $1,
+// callers put anything else (limit, offset, ...) after len(args)
+func (f AccountFilter) where() (clause string, args []any) {
+	var conds []string
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, "$"+strconv.Itoa(len(args))))
+	}
+
+	if f.CreatedAfter != nil {
+		add("created_at >= %s", *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		add("created_at < %s", *f.CreatedBefore)
+	}
+	if f.MinBalance != nil {
+		add("balance >= %s", *f.MinBalance)
+	}
+	if f.MaxBalance != nil {
+		add("balance <= %s", *f.MaxBalance)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// parseAccountFilter reads the list filters from the query string:
+// ?createdAfter= and ?createdBefore= take RFC 3339 timestamps or plain dates (midnight UTC),
+// ?minBalance= and ?maxBalance= take whole numbers in minor units, both bounds included
+func parseAccountFilter(req *http.Request) (AccountFilter, error) {
+	var f AccountFilter
+	var err error
+
+	if f.CreatedAfter, err = queryTime(req, "createdAfter"); err != nil {
+		return AccountFilter{}, err
+	}
+	if f.CreatedBefore, err = queryTime(req, "createdBefore"); err != nil {
+		return AccountFilter{}, err
+	}
+
+	if f.CreatedAfter != nil && f.CreatedBefore != nil && f.CreatedAfter.After(*f.CreatedBefore) {
+		return AccountFilter{}, fmt.Errorf("createdAfter can't be later than createdBefore")
+	}
+
+	for _, param := range []struct {
+		name string
+		dst  **int64
+	}{
+		{"minBalance", &f.MinBalance},
+		{"maxBalance", &f.MaxBalance},
+	} {
+		if req.URL.Query().Get(param.name) == "" {
+			continue
+		}
+		n, err := queryInt64(req, param.name, 0)
+		if err != nil {
+			return AccountFilter{}, err
+		}
+		*param.dst = &n
+	}
+
+	if f.MinBalance != nil && f.MaxBalance != nil && *f.MinBalance > *f.MaxBalance {
+		return AccountFilter{}, fmt.Errorf("minBalance can't be bigger than maxBalance")
+	}
+	return f, nil
+}
+
+// relativeTimeUnits are the units a relative time (-7d) can be in
+var relativeTimeUnits = map[byte]time.Duration{'d': 24 * time.Hour, 'h': time.Hour, 'm': time.Minute}
+
+// parseFilterTime accepts a full RFC 3339 timestamp, a date, which means midnight UTC that day, or a time
+// relative to now: a minus, a whole number and d, h or m, ex. -7d is exactly 7*24 hours ago
+func parseFilterTime(v string) (time.Time, error) {
+	if strings.HasPrefix(v, "-") {
+		return parseRelativeTime(v, time.Now().UTC())
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
+
+// parseRelativeTime turns -<n><unit> into the time that long before now
+func parseRelativeTime(v string, now time.Time) (time.Time, error) {
+	if len(v) < 3 {
+		return time.Time{}, fmt.Errorf("invalid relative time %q", v)
+	}
+	unit, ok := relativeTimeUnits[v[len(v)-1]]
+	n, err := strconv.ParseInt(v[1:len(v)-1], 10, 64)
+	// the digits only, ParseInt would take another sign. and nothing so big the duration overflows
+	if !ok || err != nil || v[1] < '0' || v[1] > '9' || n > int64(math.MaxInt64/unit) {
+		return time.Time{}, fmt.Errorf("invalid relative time %q", v)
+	}
+	return now.Add(-time.Duration(n) * unit), nil
+}
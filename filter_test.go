@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRelativeTime(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"-7d", now.Add(-7 * 24 * time.Hour)},
+		{"-12h", now.Add(-12 * time.Hour)},
+		{"-30m", now.Add(-30 * time.Minute)},
+		{"-0d", now},
+		{"-007h", now.Add(-7 * time.Hour)},
+		{"-106751d", now.Add(-106751 * 24 * time.Hour)}, // the most days a time.Duration holds
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseRelativeTime(tt.in, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRelativeTimeMalformed(t *testing.T) {
+	for _, in := range []string{
+		"-", "-d", "--7d", "-+7d", "-7x", "- 7d", "-7 d", "-7", "-7D", "-1.5h", "-7dd",
+		"-106752d",               // overflows time.Duration
+		"-9223372036854775807m",  // so does this
+		"-99999999999999999999h", // doesn't fit an int64 at all
+	} {
+		t.Run(in, func(t *testing.T) {
+			if got, err := parseRelativeTime(in, time.Now()); err == nil {
+				t.Fatalf("got %v, want an error", got)
+			}
+		})
+	}
+}
+
+func TestParseFilterTime(t *testing.T) {
+	for in, want := range map[string]string{
+		"2024-01-31":                "2024-01-31T00:00:00Z",
+		"2024-01-31T23:59:59Z":      "2024-01-31T23:59:59Z",
+		"2024-01-31T23:59:59-05:00": "2024-02-01T04:59:59Z",
+	} {
+		got, err := parseFilterTime(in)
+		if err != nil {
+			t.Fatalf("%s: %v", in, err)
+		}
+		if got.UTC().Format(time.RFC3339) != want {
+			t.Fatalf("%s: got %v, want %s", in, got, want)
+		}
+	}
+	if _, err := parseFilterTime("-7x"); err == nil {
+		t.Fatal("-7x parsed")
+	}
+}
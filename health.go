@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// readiness states reported by /ready
+const (
+	readinessMigrating = "migrating"
+	readinessReady     = "ready"
+)
+
+type ReadinessResponse struct {
+	Status string `json:"status"`
+}
+
+// MarkReady tells the server schema setup is done, from then on /ready is 200 and the API takes requests
+func (s *APIServer) MarkReady() {
+	s.ready.Store(true)
+}
+
+// handleReady is the readiness probe. it's 503 "migrating" until MarkReady so load balancers hold off
+// sending traffic while the schema is being set up. it isn't behind basic auth, probes don't have credentials
+func (s *APIServer) handleReady(w http.ResponseWriter, req *http.Request) {
+	if !s.ready.Load() {
+		WriteJSON(w, http.StatusServiceUnavailable, ReadinessResponse{Status: readinessMigrating})
+		return
+	}
+	WriteJSON(w, http.StatusOK, ReadinessResponse{Status: readinessReady})
+}
+
+// requireReady turns requests away with a 503 until MarkReady, so nothing runs against a half set up schema
+func (s *APIServer) requireReady(next http.Handler) http.Handler {
+	return makeHTTPHandleFunc(func(w http.ResponseWriter, req *http.Request) error {
+		if !s.ready.Load() {
+			return newRetryableError(http.StatusServiceUnavailable, startupRetryAfter, "the server is still starting up, try again shortly")
+		}
+		next.ServeHTTP(w, req)
+		return nil
+	})
+}
+
+// HealthCheck checks one dependency for GET /health/detailed, nil means it's healthy
+type HealthCheck func(ctx context.Context) error
+
+type namedHealthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// healthCheckTimeout bounds each check, a dependency that hangs counts as failed
+const healthCheckTimeout = 5 * time.Second
+
+// health statuses, per check and overall
+const (
+	healthPass = "pass"
+	healthFail = "fail"
+)
+
+type HealthCheckResult struct {
+	Status     string `json:"status"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// HealthResponse is GET /health/detailed. Status is "pass" only if every check passed
+type HealthResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]HealthCheckResult `json:"checks"`
+}
+
+// RegisterHealthCheck adds a named check to GET /health/detailed. register everything before Start,
+// the list isn't guarded for changes while requests read it
+func (s *APIServer) RegisterHealthCheck(name string, check HealthCheck) {
+	s.healthChecks = append(s.healthChecks, namedHealthCheck{name: name, check: check})
+}
+
+// handleHealthDetailed runs every registered check at once and reports each one. it's 200 when all of them
+// pass and 503 otherwise, so a dashboard (or a probe) can go by the status alone
+func (s *APIServer) handleHealthDetailed(w http.ResponseWriter, req *http.Request) error {
+	return methods{
+		http.MethodGet: func() error {
+			resp := HealthResponse{Status: healthPass, Checks: make(map[string]HealthCheckResult, len(s.healthChecks))}
+
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			for _, c := range s.healthChecks {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+					defer cancel()
+
+					start := time.Now()
+					err := c.check(ctx)
+					result := HealthCheckResult{Status: healthPass, DurationMs: time.Since(start).Milliseconds()}
+					if err != nil {
+						result.Status, result.Error = healthFail, err.Error()
+					}
+
+					mu.Lock()
+					defer mu.Unlock()
+					resp.Checks[c.name] = result
+					if err != nil {
+						resp.Status = healthFail
+					}
+				}()
+			}
+			wg.Wait()
+
+			status := http.StatusOK
+			if resp.Status != healthPass {
+				status = http.StatusServiceUnavailable
+			}
+			return WriteJSON(w, status, resp)
+		},
+	}.serve(w, req)
+}
+
+// checkTempWritable is a HealthCheck that creates (and removes) a file in the temp dir
+func checkTempWritable(ctx context.Context) error {
+	f, err := os.CreateTemp("", "gobank-health-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
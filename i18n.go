@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/text/language"
+)
+
+// supportedLanguages are the languages error messages come in, the first one is the fallback.
+// English messages are the ones the code writes, the others come from messageCatalog
+var supportedLanguages = []language.Tag{language.English, language.Spanish}
+
+var languageMatcher = language.NewMatcher(supportedLanguages)
+
+// messageCatalog holds the translated message for each error code. these are generic on purpose: the English
+// message can have details in it (ids, amounts, ...) but a translation only knows the code.
+// a code missing here falls back to the English message
+var messageCatalog = map[language.Tag]map[ErrorCode]string{
+	language.Spanish: {
+		CodeBadRequest:          "solicitud no válida",
+		CodeInvalidJSON:         "el cuerpo de la solicitud no es JSON válido",
+		CodeBodyRequired:        "falta el cuerpo de la solicitud",
+		CodeUnknownField:        "el cuerpo de la solicitud tiene un campo desconocido",
+		CodeOutOfRange:          "un valor numérico está fuera de rango",
+		CodePayloadTooLarge:     "el cuerpo de la solicitud es demasiado grande",
+		CodeUnsupportedMedia:    "tipo de contenido no admitido",
+		CodeValidationFailed:    "la validación falló",
+		CodeUnauthorized:        "no autorizado",
+		CodeForbidden:           "acceso denegado",
+		CodeNotFound:            "no encontrado",
+		CodeAccountNotFound:     "no se encontró la cuenta",
+		CodeMethodNotAllowed:    "método no permitido",
+		CodeConflict:            "otra solicitud modificó la cuenta, inténtelo de nuevo",
+		CodeGone:                "este recurso ya no está disponible",
+		CodeTimeout:             "la base de datos tardó demasiado en responder",
+		CodeUnavailable:         "el servicio no está disponible en este momento, inténtelo de nuevo en breve",
+		CodeInternal:            "error interno del servidor",
+		CodeUnsupportedCurrency: "moneda no admitida",
+		CodeCurrencyMismatch:    "las monedas de las cuentas no coinciden",
+		CodeNoExchangeRate:      "no hay tipo de cambio entre estas monedas",
+		CodeInvalidAmount:       "el importe debe ser positivo",
+		CodeSelfTransfer:        "no se puede transferir a la misma cuenta",
+		CodeAmountOverflow:      "el importe es demasiado grande",
+		CodeInsufficientFunds:   "fondos insuficientes",
+		CodeTransferRejected:    "la transferencia fue rechazada, no se movió dinero",
+
+		CodeConfirmationRequired: "la cuenta tiene saldo o historial, confirme la eliminación",
+
+		CodeTransferLimitExceeded: "la transferencia supera el límite diario de la cuenta",
+
+		CodeDuplicateName: "ya existe una cuenta con este nombre",
+
+		CodeReferenceInUse: "otra cuenta ya usó esta referencia de transferencia",
+
+		CodeTooManyRequests: "demasiadas solicitudes, inténtelo de nuevo más tarde",
+	},
+}
+
+// negotiateLanguage picks the best supported language for the request's Accept-Language header
+func negotiateLanguage(req *http.Request) language.Tag {
+	tags, _, _ := language.ParseAcceptLanguage(req.Header.Get("Accept-Language")) // a bad header just means no preference
+	_, i, _ := languageMatcher.Match(tags...)
+	return supportedLanguages[i]
+}
+
+// localizeError sets apiErr's message to the request's language, leaving the English message when
+// there's no translation. it also sets Content-Language to whatever was used
+func localizeError(w http.ResponseWriter, req *http.Request, apiErr *APIError) {
+	lang := negotiateLanguage(req)
+	if msg, ok := messageCatalog[lang][apiErr.Code]; ok {
+		apiErr.Error = msg
+	} else {
+		lang = language.English
+	}
+	w.Header().Set("Content-Language", lang.String())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// keyedLocks is an in-process lock per account id, so money operations on the same account in this instance
+// run one at a time instead of piling up on Postgres row locks. it's only the first layer: other instances
+// don't see it, the SELECT ... FOR UPDATE inside the store's transactions is what holds across instances.
+// locks for ids nobody holds or waits on are dropped, so the map only grows with the accounts in use
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[int]*keyedLock
+}
+
+type keyedLock struct {
+	held chan struct{} // holds a value while someone has the lock, waiting on a send is waiting for the lock
+	refs int           // holders plus waiters, the entry goes when it drops to 0
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: map[int]*keyedLock{}}
+}
+
+// Lock takes the locks for every id, in ascending order so two callers locking overlapping ids can't
+// deadlock each other. it gives up when ctx is done, releasing whatever it already had. the returned func
+// releases everything, call it once the operation is over
+func (k *keyedLocks) Lock(ctx context.Context, ids ...int) (unlock func(), err error) {
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	var held []int
+	unlock = func() {
+		for _, id := range held {
+			k.release(id)
+		}
+	}
+
+	for _, id := range ids {
+		l := k.acquireRef(id)
+		select {
+		case l.held <- struct{}{}:
+			held = append(held, id)
+		case <-ctx.Done():
+			k.dropRef(id)
+			unlock()
+			return nil, ctx.Err()
+		}
+	}
+	return unlock, nil
+}
+
+// acquireRef returns the lock for id, creating it if needed, and counts the caller as a user of it
+func (k *keyedLocks) acquireRef(id int) *keyedLock {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, ok := k.locks[id]
+	if !ok {
+		l = &keyedLock{held: make(chan struct{}, 1)}
+		k.locks[id] = l
+	}
+	l.refs++
+	return l
+}
+
+// dropRef undoes acquireRef, removing the lock once nobody holds or waits on it
+func (k *keyedLocks) dropRef(id int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if l := k.locks[id]; l != nil {
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, id)
+		}
+	}
+}
+
+// release gives up a lock taken by Lock
+func (k *keyedLocks) release(id int) {
+	k.mu.Lock()
+	l := k.locks[id]
+	k.mu.Unlock()
+
+	<-l.held
+	k.dropRef(id)
+}
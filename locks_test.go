@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// run with -race: 200 goroutines lock overlapping pairs in both orders, a deadlock hangs the test and a
+// missing lock shows up as a lost increment
+func TestKeyedLocksOverlappingPairs(t *testing.T) {
+	locks := newKeyedLocks()
+	counters := make([]int, 5)
+
+	var wg sync.WaitGroup
+	for i := range 200 {
+		a, b := i%5, (i+1)%5
+		if i%2 == 1 {
+			a, b = b, a
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locks.Lock(context.Background(), a, b)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+			counters[a]++
+			counters[b]++
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlocked")
+	}
+
+	total := 0
+	for _, c := range counters {
+		total += c
+	}
+	if total != 400 {
+		t.Fatalf("counted %d increments, want 400", total)
+	}
+	if len(locks.locks) != 0 {
+		t.Fatalf("%d locks left in the map after everything was released", len(locks.locks))
+	}
+}
+
+func TestKeyedLocksSameIDTwice(t *testing.T) {
+	locks := newKeyedLocks()
+	unlock, err := locks.Lock(context.Background(), 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if len(locks.locks) != 0 {
+		t.Fatalf("%d locks left in the map", len(locks.locks))
+	}
+}
+
+// a caller that times out waiting gives back the locks it already had, so the next caller isn't stuck
+func TestKeyedLocksTimeoutReleases(t *testing.T) {
+	locks := newKeyedLocks()
+	unlockHolder, err := locks.Lock(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	// gets 1, then waits on 2 until the timeout
+	if _, err := locks.Lock(ctx, 1, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	unlock, err := locks.Lock(ctx, 1)
+	if err != nil {
+		t.Fatalf("lock 1 still held after the timed out caller gave up: %v", err)
+	}
+	unlock()
+	unlockHolder()
+
+	if len(locks.locks) != 0 {
+		t.Fatalf("%d locks left in the map", len(locks.locks))
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setupLogging points the default slog logger (and with it the std "log" package) at LOG_OUTPUT in LOG_FORMAT,
+// dropping anything below LOG_LEVEL.
+//
+//	LOG_OUTPUT: stdout (default) | stderr | file:/path/to/file
+//	LOG_FORMAT: text (default) | json | clf (request lines in Combined Log Format, everything else as text)
+//	LOG_LEVEL:  debug | info (default) | warn | error
+//
+// when logging to a file the opened file is returned so main can close it on shutdown, otherwise the closer is nil
+func setupLogging(output, format, level string) (io.Closer, error) {
+	var w io.Writer
+	var closer io.Closer
+
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if level != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL %q, expected debug, info, warn or error", level)
+		}
+		opts.Level = l
+	}
+
+	switch {
+	case output == "" || output == "stdout":
+		w = os.Stdout
+	case output == "stderr":
+		w = os.Stderr
+	case strings.HasPrefix(output, "file:"):
+		path := strings.TrimPrefix(output, "file:")
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("opening log file: %w", err)
+		}
+		w, closer = f, f
+	default:
+		return nil, fmt.Errorf("invalid LOG_OUTPUT %q, expected stdout, stderr or file:/path", output)
+	}
+
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "clf":
+		handler = slog.NewTextHandler(w, opts)
+		accessLog = w
+	default:
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, fmt.Errorf("invalid LOG_FORMAT %q, expected text, json or clf", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return closer, nil
+}
+
+// statusClientClosedRequest is nginx's non-standard status for a request the client gave up on before
+// getting an answer. it's never sent, it only shows up in the logs
+const statusClientClosedRequest = 499
+
+// accessLog is where LOG_FORMAT=clf writes its request lines, nil for the other formats (the request line is
+// a regular slog record then). setupLogging sets it, like the default slog logger it's process wide
+var accessLog io.Writer
+
+// statusRecorder remembers the status a handler wrote, and how many body bytes, so it can be logged afterwards
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status, r.wrote = status, true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wrote = true
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// logRequests logs one line per request once it's done, with the real client IP (see clientIP). it also keeps
+// the request counters for /admin/runtime, and warns about requests slower than SLOW_REQUEST_THRESHOLD
+func (s *APIServer) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		s.totalRequests.Add(1)
+		s.activeRequests.Add(1)
+		defer s.activeRequests.Add(-1)
+
+		next.ServeHTTP(rec, req)
+
+		// nothing was written because the client went away first (see makeHTTPHandleFunc)
+		if !rec.wrote && errors.Is(req.Context().Err(), context.Canceled) {
+			rec.status = statusClientClosedRequest
+		}
+
+		duration := time.Since(start)
+		attrs := []any{
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", rec.status,
+			"duration", duration,
+			"clientIP", s.clientIP(req),
+		}
+		if accessLog != nil {
+			if slog.Default().Enabled(req.Context(), slog.LevelInfo) {
+				writeCombinedLog(accessLog, s.clientIP(req), start, req, rec.status, rec.size)
+			}
+		} else {
+			slog.Info("request", attrs...)
+		}
+		if s.cfg.SlowRequestThreshold > 0 && duration > s.cfg.SlowRequestThreshold {
+			slog.Warn("slow request", append(attrs, "threshold", s.cfg.SlowRequestThreshold)...)
+		}
+	})
+}
+
+// clfTimeFormat is the timestamp format of the Common Log Format, ex. 10/Oct/2000:13:55:36 -0700
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// writeCombinedLog writes one request in the Combined Log Format, the Apache/nginx access log most log tools
+// read as is: ip - user [time] "request line" status size "referer" "user-agent". the user is the basic auth
+// name the client sent (checked or not, like Apache's %u) and fields without a value are "-"
+func writeCombinedLog(w io.Writer, ip string, start time.Time, req *http.Request, status, size int) {
+	user := "-"
+	if u, _, ok := req.BasicAuth(); ok && u != "" {
+		user = clfEscape(u)
+	}
+	bytesSent := "-"
+	if size > 0 {
+		bytesSent = strconv.Itoa(size)
+	}
+	requestLine := req.Method + " " + req.URL.RequestURI() + " " + req.Proto
+
+	// one Write per line so concurrent requests don't interleave
+	fmt.Fprintf(w, "%s - %s [%s] \"%s\" %d %s \"%s\" \"%s\"\n",
+		ip, user, start.Format(clfTimeFormat), clfEscape(requestLine), status, bytesSent,
+		clfOrDash(req.Referer()), clfOrDash(req.UserAgent()))
+}
+
+// clfEscape escapes quotes, backslashes and control characters so a value can't break out of its field
+// or start a fake log line
+func clfEscape(s string) string {
+	quoted := strconv.Quote(s)
+	return quoted[1 : len(quoted)-1]
+}
+
+func clfOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return clfEscape(s)
+}
+
+// maxLoggedBody is how much of a body logBodies prints, the rest is cut off
+const maxLoggedBody = 2 << 10 // 2 KiB
+
+// redactedFields are JSON keys (matched case-insensitively, at any depth) whose values never make it into the logs
+var redactedFields = map[string]bool{"pin": true}
+
+// bodyRecorder keeps a copy of what the handler writes, up to maxBodyBytes, for logBodies
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bodyRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	if room := maxBodyBytes - r.body.Len(); room > 0 {
+		r.body.Write(b[:min(len(b), room)])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// logBodies logs request and response bodies at debug level, with sensitive fields redacted and long
+// bodies truncated. it's for local debugging only: it does nothing unless LOG_LEVEL=debug, and bodies
+// still hold names and balances, so don't run production at debug level
+func logBodies(next http.Handler) http.Handler {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return next
+	}
+	slog.Warn("LOG_LEVEL=debug: request and response bodies are being logged, don't use this in production")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// read what the decoder would accept (plus a byte so it still sees an oversized body as too large) and
+		// put it back in front of whatever is left, so handlers read the same body they would have without us
+		reqBody, _ := io.ReadAll(io.LimitReader(req.Body, maxBodyBytes+1))
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(reqBody), req.Body))
+
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+
+		slog.Debug("request bodies",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", rec.status,
+			"requestBody", loggableBody(reqBody),
+			"responseBody", loggableBody(rec.body.Bytes()),
+		)
+	})
+}
+
+// loggableBody redacts and truncates a body for the logs. bodies that aren't JSON can't be redacted,
+// so only their size is logged
+func loggableBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	// UseNumber so big numbers show up as sent instead of going through a float64
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Sprintf("<%d bytes, not JSON>", len(body))
+	}
+	redacted, err := json.Marshal(redact(v))
+	if err != nil {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+
+	if len(redacted) > maxLoggedBody {
+		return fmt.Sprintf("%s... (%d bytes)", redacted[:maxLoggedBody], len(redacted))
+	}
+	return string(redacted)
+}
+
+// redact replaces the values of redactedFields anywhere in a decoded JSON value
+func redact(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, val := range v {
+			if redactedFields[strings.ToLower(key)] {
+				v[key] = "[REDACTED]"
+			} else {
+				v[key] = redact(val)
+			}
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = redact(val)
+		}
+	}
+	return v
+}
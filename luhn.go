@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// luhnCheckDigit computes the Luhn check digit for payload, the account number without its check digit
+func luhnCheckDigit(payload int64) int64 {
+	var sum int64
+	double := true // the digit right next to the (future) check digit gets doubled
+	for n := payload; n > 0; n /= 10 {
+		d := n % 10
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
+
+// withCheckDigit appends the Luhn check digit to payload (ex. 7992739871 => 79927398713)
+func withCheckDigit(payload int64) (int64, error) {
+	if payload <= 0 || payload > (math.MaxInt64-9)/10 {
+		return 0, fmt.Errorf("account number payload %d out of range", payload)
+	}
+	return payload*10 + luhnCheckDigit(payload), nil
+}
+
+// ValidateAccountNumber reports whether number ends in a valid Luhn check digit.
+// it catches every single digit typo and most swapped neighbours without touching the DB
+func ValidateAccountNumber(number int64) bool {
+	if number < 10 { // need at least one payload digit plus the check digit
+		return false
+	}
+	return luhnCheckDigit(number/10) == number%10
+}
+
+// maxAccountNumberLength is the most digits an account number can have and still fit an int64 (a BIGINT)
+const maxAccountNumberLength = 18
+
+// AccountNumberFormat shapes new account numbers: Prefix (a branch or product code) followed by the sequence
+// value, zero padded to fill Length digits, and the Luhn check digit. without a Prefix, Length is an upper
+// bound since a number can't start with zeros. the zero value is the original format, a sequence value and
+// its check digit
+type AccountNumberFormat struct {
+	Length int    `json:"length,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// ParseAccountNumberFormat parses ACCOUNT_NUMBER_LENGTH and ACCOUNT_NUMBER_PREFIX, making sure the length
+// leaves room for the prefix, at least one sequence digit and the check digit
+func ParseAccountNumberFormat(length, prefix string) (AccountNumberFormat, error) {
+	var f AccountNumberFormat
+
+	if prefix != "" {
+		if strings.Trim(prefix, "0123456789") != "" || prefix[0] == '0' {
+			return f, fmt.Errorf("invalid ACCOUNT_NUMBER_PREFIX %q, expected digits not starting with 0", prefix)
+		}
+		f.Prefix = prefix
+	}
+
+	if length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 2 || n > maxAccountNumberLength {
+			return f, fmt.Errorf("invalid ACCOUNT_NUMBER_LENGTH %q, expected 2 to %d digits", length, maxAccountNumberLength)
+		}
+		f.Length = n
+	}
+
+	switch {
+	case f.Prefix != "" && f.Length == 0:
+		return f, fmt.Errorf("ACCOUNT_NUMBER_PREFIX needs ACCOUNT_NUMBER_LENGTH")
+	case f.Length > 0 && len(f.Prefix)+2 > f.Length:
+		return f, fmt.Errorf("ACCOUNT_NUMBER_LENGTH %d has no room for prefix %q, a sequence digit and the check digit", f.Length, f.Prefix)
+	}
+	return f, nil
+}
+
+// number builds the account number for sequence value seq. it fails once seq no longer fits the format,
+// the format then has to get longer (or a new prefix) before more accounts can be opened
+func (f AccountNumberFormat) number(seq int64) (int64, error) {
+	if f.Length == 0 {
+		return withCheckDigit(seq)
+	}
+
+	seqDigits := f.Length - len(f.Prefix) - 1 // the rest is the prefix and the check digit
+	limit := int64(math.Pow10(seqDigits))
+	if seq <= 0 || seq >= limit {
+		return 0, fmt.Errorf("account number sequence value %d doesn't fit %d digits, the account number format is exhausted", seq, seqDigits)
+	}
+
+	payload := seq
+	if f.Prefix != "" {
+		prefix, err := strconv.ParseInt(f.Prefix, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		payload += prefix * limit
+	}
+	return withCheckDigit(payload)
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestLuhnCheckDigit(t *testing.T) {
+	tests := []struct {
+		payload int64
+		digit   int64
+	}{
+		{7992739871, 3},
+		{1, 8},
+		{42, 2},
+		{400000000000000, 2}, // 4000 0000 0000 0002 minus its last digit
+		{37828224631000, 5},  // 3782 822463 10005
+	}
+	for _, tt := range tests {
+		if got := luhnCheckDigit(tt.payload); got != tt.digit {
+			t.Errorf("luhnCheckDigit(%d) = %d, want %d", tt.payload, got, tt.digit)
+		}
+	}
+}
+
+func TestWithCheckDigit(t *testing.T) {
+	got, err := withCheckDigit(7992739871)
+	if err != nil || got != 79927398713 {
+		t.Fatalf("withCheckDigit(7992739871) = %d, %v, want 79927398713", got, err)
+	}
+	for _, payload := range []int64{0, -5, 922337203685477580} {
+		if _, err := withCheckDigit(payload); err == nil {
+			t.Errorf("withCheckDigit(%d) didn't fail", payload)
+		}
+	}
+}
+
+func TestValidateAccountNumber(t *testing.T) {
+	valid := []int64{79927398713, 18, 422, 4000000000000002, 378282246310005}
+	for _, n := range valid {
+		if !ValidateAccountNumber(n) {
+			t.Errorf("%d should be valid", n)
+		}
+	}
+
+	invalid := []int64{
+		79927398710, 79927398711, 79927398719, // wrong check digit
+		79927398703, // one digit off
+		97927398713, // neighbours swapped
+		8, 0, -18,
+	}
+	for _, n := range invalid {
+		if ValidateAccountNumber(n) {
+			t.Errorf("%d should be invalid", n)
+		}
+	}
+}
+
+func TestAccountNumberFormat(t *testing.T) {
+	f, err := ParseAccountNumberFormat("12", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := f.number(1); err != nil || got != 420000000018 {
+		t.Fatalf("number(1) = %d, %v, want 420000000018", got, err)
+	}
+	if _, err := f.number(1_000_000_000); err == nil {
+		t.Fatal("a sequence value too long for the format didn't fail")
+	}
+}
@@ -1,26 +1,129 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/joho/godotenv"
 )
 
 func main() {
+	check := flag.Bool("check", false, "check the config, database connection and schema, print a report and exit")
+	flag.Parse()
+
 	if err := godotenv.Load(); err != nil {
 		log.Fatal("error loading .env file:", err)
 	}
 
+	if *check {
+		os.Exit(runSelfCheck(os.Stdout))
+	}
+
+	logFile, err := setupLogging(os.Getenv("LOG_OUTPUT"), os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if logFile != nil {
+		defer logFile.Close() // flush/close the log file on shutdown
+	}
+
+	slog.Info("starting gobank", "version", version, "commit", commit, "buildDate", buildDate)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	store, err := NewPostgresStore()
 	if err != nil { // issue with creating our postgresstore
 		log.Fatal(err)
 	}
 	defer store.db.Close() // close the db after we exit (from an error or something else)
 
-	if err := store.Setup(); err != nil { // issue w/ setup (i.e. table creation failed)
+	if len(cfg.ExchangeRates) > 0 {
+		store.rates = cfg.ExchangeRates
+	}
+	store.numberFormat = cfg.AccountNumbers
+	store.uniqueNames = cfg.EnforceUniqueNames
+
+	// the circuit breaker is on by default, DB_BREAKER_FAILURES=0 turns it off
+	var accountStore AccountStore = store
+	breaker, err := NewBreakerStore(store)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if breaker != nil {
+		accountStore = breaker
+	}
 
-	server := NewAPIServer(":3000", store)
-	server.Start()
+	// the account cache is off by default, ACCOUNT_CACHE_SIZE > 0 turns it on.
+	// it goes in front of the breaker so cache hits still work while the database is down
+	var cache *CachedStore
+	if v := os.Getenv("ACCOUNT_CACHE_SIZE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 0 {
+			log.Fatalf("invalid ACCOUNT_CACHE_SIZE %q", v)
+		}
+		if size > 0 {
+			cache = NewCachedStore(accountStore, size)
+			accountStore = cache
+		}
+	}
+
+	// handlers publish account events here, anything that reacts to them subscribes below
+	events := NewEventBus[AccountEvent]()
+
+	// webhooks are optional, WEBHOOK_URL turns them on and every payload is signed with WEBHOOK_SECRET
+	if url := os.Getenv("WEBHOOK_URL"); url != "" {
+		secret := os.Getenv("WEBHOOK_SECRET")
+		if secret == "" {
+			log.Fatal("WEBHOOK_SECRET must be set when WEBHOOK_URL is")
+		}
+		webhooks := NewWebhookDispatcher(url, secret)
+		webhooks.Start()
+		events.Subscribe(webhooks.HandleEvent)
+	}
+
+	server := NewAPIServer(":3000", accountStore, events, cfg)
+	if breaker != nil {
+		server.breaker = breaker // for /admin/runtime
+	}
+	if cache != nil {
+		server.cache = cache // for /admin/runtime
+	}
+
+	// /health/detailed, these talk to Postgres directly so they report on it even while the breaker is open
+	server.RegisterHealthCheck("database", store.db.PingContext)
+	server.RegisterHealthCheck("schema", store.VerifySchema)
+	server.RegisterHealthCheck("tempDir", checkTempWritable)
+
+	// listen before the schema setup so /ready can say "migrating" while it runs, the API itself
+	// answers 503 until MarkReady
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Start() }()
+
+	if err := store.Setup(); err != nil { // issue w/ setup (i.e. table creation failed)
+		slog.Error("schema setup failed, exiting", "error", err)
+		store.db.Close()
+		os.Exit(1)
+	}
+	server.MarkReady()
+	slog.Info("schema setup done, ready for traffic")
+
+	// the first SIGTERM/ctrl-c drains in-flight requests for up to SHUTDOWN_TIMEOUT, a second one cuts it short
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		slog.Info("got signal", "signal", sig.String())
+		server.Shutdown(cfg.ShutdownTimeout, signals)
+	}
 }
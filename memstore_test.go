@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory AccountStore for handler tests. it keeps the parts of PostgresStore's behaviour the
+// handlers depend on (not found errors, delete confirmation, transfer rejections) and nothing else
+type memStore struct {
+	mu     sync.Mutex
+	accs   map[int]*Account
+	nextID int
+
+	// completed batches by reference, with the account they came from
+	references map[string]*TransferBatchResult
+
+	// beforeUpdate runs at the start of UpdateAccount without the lock held, so a test can change the store
+	// between a handler's read and its write, like another instance would
+	beforeUpdate func(id int)
+}
+
+func newMemStore(accs ...Account) *memStore {
+	m := &memStore{accs: map[int]*Account{}}
+	for _, acc := range accs {
+		m.accs[acc.ID] = &acc
+		m.nextID = max(m.nextID, acc.ID)
+	}
+	return m
+}
+
+func notFound(id int) error {
+	return fmt.Errorf("%w with id %d", ErrAccountNotFound, id)
+}
+
+func (m *memStore) CreateAccount(_ context.Context, req *CreateAccountRequest, _ string) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	now := time.Now().UTC()
+	acc := &Account{ID: m.nextID, FirstName: req.FirstName, LastName: req.LastName, Number: int64(m.nextID),
+		Balance: req.InitialBalance, Currency: req.Currency, CreatedAt: now, UpdatedAt: now}
+	m.accs[acc.ID] = acc
+	copied := *acc
+	return &copied, nil
+}
+
+func (m *memStore) DeleteAccount(_ context.Context, id int, force bool, _ string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	acc, ok := m.accs[id]
+	if !ok {
+		return notFound(id)
+	}
+	if acc.Balance != 0 && !force {
+		return fmt.Errorf("%w: account %d still holds %d", ErrDeleteNeedsConfirmation, id, acc.Balance)
+	}
+	delete(m.accs, id)
+	return nil
+}
+
+func (m *memStore) UpdateAccount(_ context.Context, id int, req *UpdateAccountRequest, _ string) (*Account, error) {
+	if m.beforeUpdate != nil {
+		m.beforeUpdate(id)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	acc, ok := m.accs[id]
+	if !ok {
+		return nil, notFound(id)
+	}
+	acc.FirstName, acc.LastName = req.FirstName, req.LastName
+	if req.Balance != nil {
+		acc.Balance = *req.Balance
+	}
+	acc.UpdatedAt = time.Now().UTC()
+	copied := *acc
+	return &copied, nil
+}
+
+func (m *memStore) UpsertAccount(ctx context.Context, id int, req *UpdateAccountRequest, actor string) (*Account, bool, error) {
+	m.mu.Lock()
+	_, exists := m.accs[id]
+	if !exists {
+		now := time.Now().UTC()
+		m.accs[id] = &Account{ID: id, Number: int64(id), Currency: defaultCurrency, CreatedAt: now, UpdatedAt: now}
+		m.nextID = max(m.nextID, id)
+	}
+	m.mu.Unlock()
+
+	acc, err := m.UpdateAccount(ctx, id, req, actor)
+	return acc, !exists, err
+}
+
+func (m *memStore) GetAccountByID(_ context.Context, id int) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	acc, ok := m.accs[id]
+	if !ok {
+		return nil, notFound(id)
+	}
+	copied := *acc
+	return &copied, nil
+}
+
+func (m *memStore) ListAccounts(_ context.Context, _ AccountFilter, limit, offset int) ([]Account, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := slices.Sorted(maps.Keys(m.accs))
+	accounts := []Account{}
+	for _, id := range ids[min(offset, len(ids)):min(offset+limit, len(ids))] {
+		accounts = append(accounts, *m.accs[id])
+	}
+	return accounts, len(ids), nil
+}
+
+func (m *memStore) SearchAccounts(context.Context, string, int) ([]Account, error) {
+	return []Account{}, nil
+}
+
+func (m *memStore) GetAccountBalanceByID(ctx context.Context, id int) (int64, error) {
+	acc, err := m.GetAccountByID(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	return acc.Balance, nil
+}
+
+func (m *memStore) GetBalancesByIDs(ctx context.Context, ids []int) ([]BalanceResponse, error) {
+	balances := []BalanceResponse{}
+	for _, id := range ids {
+		if acc, err := m.GetAccountByID(ctx, id); err == nil {
+			balances = append(balances, BalanceResponse{ID: id, Balance: acc.Balance, Currency: acc.Currency})
+		}
+	}
+	return balances, nil
+}
+
+func (m *memStore) GroupedBalances(context.Context, string) ([]GroupRow, error) {
+	return []GroupRow{}, nil
+}
+
+func (m *memStore) SetPIN(context.Context, int, string) error { return nil }
+
+func (m *memStore) VerifyPIN(context.Context, int, string) (bool, error) { return false, nil }
+
+// TransferBatch moves money between accounts of the same currency, all or nothing like the atomic mode
+func (m *memStore) TransferBatch(_ context.Context, fromID int, entries []TransferEntry, reference, _ string) (*TransferBatchResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.references[reference]; ok && reference != "" {
+		if stored.FromAccountID != fromID {
+			return nil, fmt.Errorf("%w: %q is a transfer from account %d", ErrReferenceInUse, reference, stored.FromAccountID)
+		}
+		replayed := *stored
+		replayed.Replayed = true
+		return &replayed, nil
+	}
+
+	source, ok := m.accs[fromID]
+	if !ok {
+		return nil, notFound(fromID)
+	}
+
+	result := &TransferBatchResult{FromAccountID: fromID, Reference: reference, Status: "completed", Balance: source.Balance,
+		Results: make([]TransferResult, len(entries))}
+	failed := false
+	for i, e := range entries {
+		res := TransferResult{Index: i, ToAccountID: e.ToAccountID, Amount: e.Amount, Status: "ok"}
+		switch _, ok := m.accs[e.ToAccountID]; {
+		case e.Amount <= 0:
+			res.Status, res.Code, res.Error = "failed", CodeInvalidAmount, "amount must be positive"
+		case e.ToAccountID == fromID:
+			res.Status, res.Code, res.Error = "failed", CodeSelfTransfer, "cannot transfer to the source account"
+		case !ok:
+			res.Status, res.Code, res.Error = "failed", CodeAccountNotFound, fmt.Sprintf("no account found with id %d", e.ToAccountID)
+		case e.Currency != "" && e.Currency != source.Currency && !e.Convert:
+			res.Status, res.Code, res.Error = "failed", CodeCurrencyMismatch, "set convert to have it converted"
+		default:
+			// converted at a rate of 1, there are no exchange rates here
+			result.TotalAmount += e.Amount
+		}
+		failed = failed || res.Status == "failed"
+		result.Results[i] = res
+	}
+	if !failed && result.TotalAmount > source.Balance {
+		result.Code, result.Error = CodeInsufficientFunds, "insufficient funds"
+		failed = true
+	}
+	if failed {
+		result.Status = "rejected"
+		if result.Error == "" {
+			result.Code, result.Error = CodeTransferRejected, "one or more entries failed, no transfers were made"
+		}
+		return result, nil
+	}
+
+	for _, e := range entries {
+		dest := m.accs[e.ToAccountID]
+		result.Changes = append(result.Changes, BalanceChange{AccountID: dest.ID, Previous: dest.Balance, Current: dest.Balance + e.Amount})
+		dest.Balance += e.Amount
+	}
+	result.Changes = append(result.Changes, BalanceChange{AccountID: fromID, Previous: source.Balance, Current: source.Balance - result.TotalAmount})
+	source.Balance -= result.TotalAmount
+	result.Balance = source.Balance
+	if reference != "" {
+		if m.references == nil {
+			m.references = map[string]*TransferBatchResult{}
+		}
+		stored := *result
+		stored.Changes = nil // like the JSON in transfer_references
+		m.references[reference] = &stored
+	}
+	return result, nil
+}
+
+func (m *memStore) GetAccountByNumber(_ context.Context, number int64) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, acc := range m.accs {
+		if acc.Number == number {
+			copied := *acc
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w with number %d", ErrAccountNotFound, number)
+}
+
+func (m *memStore) GetAuditLog(context.Context, int) ([]AuditEntry, error) {
+	return []AuditEntry{}, nil
+}
+
+func (m *memStore) GetActivity(context.Context, *ActivityCursor, int) ([]AuditEntry, error) {
+	return []AuditEntry{}, nil
+}
+
+func (m *memStore) BalanceAsOf(ctx context.Context, id int, _ time.Time) (int64, error) {
+	return m.GetAccountBalanceByID(ctx, id)
+}
+
+// GetStatement has no history to go on, the balance stays where it is for the whole range
+func (m *memStore) GetStatement(ctx context.Context, id int, from, to time.Time) (*Statement, error) {
+	acc, err := m.GetAccountByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &Statement{AccountID: id, Currency: acc.Currency, From: from, To: to,
+		OpeningBalance: acc.Balance, ClosingBalance: acc.Balance, Entries: []StatementEntry{}}, nil
+}
+
+// BeginTx hands out a copy of the store that Commit copies back. writes made to the store in the meantime
+// are lost on commit, there's no isolation beyond that, which is enough for handler tests
+func (m *memStore) BeginTx(context.Context) (TxStore, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	view := &memStore{accs: make(map[int]*Account, len(m.accs)), nextID: m.nextID}
+	for id, acc := range m.accs {
+		copied := *acc
+		view.accs[id] = &copied
+	}
+	return &memTx{memStore: view, parent: m}, nil
+}
+
+type memTx struct {
+	*memStore
+	parent *memStore
+	done   bool
+}
+
+func (t *memTx) BeginTx(context.Context) (TxStore, error) { return nil, ErrNestedTx }
+
+func (t *memTx) Commit() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+
+	t.parent.mu.Lock()
+	defer t.parent.mu.Unlock()
+	t.parent.accs, t.parent.nextID = t.accs, t.nextID
+	return nil
+}
+
+func (t *memTx) Rollback() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	return nil
+}
+
+// newTestServer is an APIServer on store with cfg (the zero Config if nil), for requests through s.routes()
+func newTestServer(store AccountStore, cfg *Config) *APIServer {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	return NewAPIServer(":0", store, NewEventBus[AccountEvent](), cfg)
+}
+
+// serve sends one request to h, hdr are header name/value pairs
+func serve(h http.Handler, method, path, body string, hdr ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// wantResponse fails the test unless rec has the status and its body contains every one of want
+func wantResponse(t *testing.T, rec *httptest.ResponseRecorder, status int, want ...string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d, body: %s", rec.Code, status, rec.Body)
+	}
+	for _, w := range want {
+		if !strings.Contains(rec.Body.String(), w) {
+			t.Errorf("body %s doesn't contain %s", rec.Body, w)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPublicRoutesSkipAuth(t *testing.T) {
+	public, err := parseRouteKeys("PUBLIC_ROUTES", "POST /account, get /account/{id}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b"}), nil)
+	auth := func(next http.Handler) http.Handler { return basicAuth("user", "pass", next) }
+	h := Chain(s.routes(), perRoute(public, auth))
+
+	creds := []string{"Authorization", "Basic dXNlcjpwYXNz"} // user:pass
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		hdr    []string
+		status int
+	}{
+		{"public POST", http.MethodPost, "/v1/account", `{"firstName":"c","lastName":"d"}`, nil, http.StatusCreated},
+		{"public GET by id", http.MethodGet, "/v1/account/1", "", nil, http.StatusOK},
+		{"public HEAD goes by GET", http.MethodHead, "/v1/account/1", "", nil, http.StatusOK},
+		{"public on the unversioned alias", http.MethodGet, "/account/1", "", nil, http.StatusOK},
+		{"same path, other method", http.MethodDelete, "/v1/account/1", "", nil, http.StatusUnauthorized},
+		{"other path, same method", http.MethodGet, "/v1/account", "", nil, http.StatusUnauthorized},
+		{"sub route of a public one", http.MethodGet, "/v1/account/1/audit", "", nil, http.StatusUnauthorized},
+		{"private with credentials", http.MethodGet, "/v1/account", "", creds, http.StatusOK},
+		{"private with bad credentials", http.MethodGet, "/v1/account", "", []string{"Authorization", "Basic dXNlcjp4"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantResponse(t, serve(h, tt.method, tt.path, tt.body, tt.hdr...), tt.status)
+		})
+	}
+}
+
+func TestParseRouteKeys(t *testing.T) {
+	routes, err := parseRouteKeys("PUBLIC_ROUTES", " post /account ,, GET /account/{id}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || !routes["POST /account"] || !routes["GET /account/{id}"] {
+		t.Fatalf("got %v", routes)
+	}
+
+	for _, v := range []string{"/account", "FETCH /account", "GET account", "GET"} {
+		if _, err := parseRouteKeys("PUBLIC_ROUTES", v); err == nil {
+			t.Errorf("%q parsed", v)
+		}
+	}
+}
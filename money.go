@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// currencyFormat describes how amounts of one currency are displayed to clients
+type currencyFormat struct {
+	Symbol   string
+	Decimals int // number of minor-unit digits (ex. 2 for cents)
+}
+
+const defaultCurrency = "USD"
+
+// currencyFormats is the small set of currencies we know how to format, keyed by ISO 4217 code
+var currencyFormats = map[string]currencyFormat{
+	"USD": {Symbol: "$", Decimals: 2},
+	"CAD": {Symbol: "CA$", Decimals: 2},
+	"EUR": {Symbol: "€", Decimals: 2},
+	"GBP": {Symbol: "£", Decimals: 2},
+	"JPY": {Symbol: "¥", Decimals: 0},
+}
+
+// isSupportedCurrency reports whether we have a formatter for the given currency code
+func isSupportedCurrency(code string) bool {
+	_, ok := currencyFormats[code]
+	return ok
+}
+
+// currencyDecimals is how many minor-unit digits a currency has, unknown currencies are assumed to use 2
+func currencyDecimals(code string) int {
+	if cf, ok := currencyFormats[code]; ok {
+		return cf.Decimals
+	}
+	return 2
+}
+
+// FormatAmount turns an amount in minor units into a display string like "$1,234.56".
+// The raw integer stays the source of truth, this is only a convenience for clients.
+func FormatAmount(amount int64, currency string) string {
+	cf, ok := currencyFormats[currency]
+	if !ok {
+		// unknown currency, fall back to "1,234.56 XYZ"
+		return formatDigits(amount, 2) + " " + currency
+	}
+
+	formatted := formatDigits(amount, cf.Decimals)
+	if strings.HasPrefix(formatted, "-") {
+		return "-" + cf.Symbol + formatted[1:]
+	}
+	return cf.Symbol + formatted
+}
+
+// formatDigits formats amount with the given number of decimals and comma thousands separators (ex. 123456, 2 => "1,234.56")
+func formatDigits(amount int64, decimals int) string {
+	sign := ""
+	digits := strconv.FormatInt(amount, 10)
+	if amount < 0 {
+		sign = "-"
+		digits = digits[1:]
+	}
+
+	// left pad so there's always at least one whole digit (ex. 5 cents => "005")
+	if len(digits) <= decimals {
+		digits = strings.Repeat("0", decimals-len(digits)+1) + digits
+	}
+
+	whole := digits[:len(digits)-decimals]
+	frac := digits[len(digits)-decimals:]
+
+	var b strings.Builder
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+
+	if decimals == 0 {
+		return sign + b.String()
+	}
+	return fmt.Sprintf("%s%s.%s", sign, b.String(), frac)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"unicode"
+)
+
+// snakeCaseJSON switches JSON keys to snake_case (first_name instead of firstName) in every response, and lets
+// request bodies use them too. WriteJSON and decodeJSON are plain functions used all over, so the setting lives
+// here instead of on the server, NewAPIServer sets it from Config.SnakeCaseJSON
+var snakeCaseJSON bool
+
+// camelToSnake turns a camelCase key into snake_case. runs of capitals are kept together as one word,
+// so fromAccountID becomes from_account_id. keys that are already snake_case (or start with _, like _links)
+// come out unchanged
+func camelToSnake(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			prevLower := i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]))
+			endOfRun := i > 0 && unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || endOfRun {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// snakeToCamel turns a snake_case key into camelCase. a leading _ is kept (_links stays _links), and a key
+// without underscores comes out unchanged so camelCase keys keep working. encoding/json matches field
+// names case-insensitively, so to_account_id -> toAccountId still finds toAccountID
+func snakeToCamel(s string) string {
+	prefix := s[:len(s)-len(strings.TrimLeft(s, "_"))]
+	words := strings.Split(s[len(prefix):], "_")
+	for i := 1; i < len(words); i++ {
+		if words[i] != "" {
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+	return prefix + strings.Join(words, "")
+}
+
+// renameKeys rewrites every object key in the first JSON value in data with rename, at any depth. numbers go
+// through as written (UseNumber), and whatever follows the value is kept as is so decodeJSON can still complain
+// about it. the value comes out compact and, since it goes through a map, with its keys sorted
+func renameKeys(data []byte, rename func(string) string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	renamed, err := json.Marshal(renameValue(v, rename))
+	if err != nil {
+		return nil, err
+	}
+	return append(renamed, data[dec.InputOffset():]...), nil
+}
+
+func renameValue(v any, rename func(string) string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		renamed := make(map[string]any, len(v))
+		for key, val := range v {
+			renamed[rename(key)] = renameValue(val, rename)
+		}
+		return renamed
+	case []any:
+		for i, val := range v {
+			v[i] = renameValue(val, rename)
+		}
+	}
+	return v
+}
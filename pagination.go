@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// limitCappedHeader is set to the limit actually used when a request asked for more than it was allowed
+const limitCappedHeader = "X-Limit-Capped"
+
+// parsePagination reads ?limit= and ?offset= for list endpoints. a missing limit falls back to the configured
+// default and anything outside [1, MaxPageSize] is clamped, but values that aren't numbers are a 400.
+// LIST_HARD_CAP is a deploy-wide ceiling on top of that, when either one lowers the limit the response says so
+// in the X-Limit-Capped header
+func (s *APIServer) parsePagination(w http.ResponseWriter, req *http.Request) (limit, offset int, err error) {
+	defaultSize, maxSize := s.cfg.DefaultPageSize, s.cfg.MaxPageSize
+	if maxSize < 1 {
+		maxSize = maxPageSize
+	}
+	if s.cfg.ListHardCap > 0 {
+		maxSize = min(maxSize, s.cfg.ListHardCap)
+	}
+	if defaultSize < 1 || defaultSize > maxSize {
+		defaultSize = min(defaultPageSize, maxSize)
+	}
+
+	query := req.URL.Query()
+
+	limit = defaultSize
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if errors.Is(err, strconv.ErrRange) {
+			err = nil // Atoi saturates to MaxInt/MinInt, which the clamping below handles like any other big limit
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid limit %q: must be a number", v)
+		}
+		if limit > maxSize {
+			limit = maxSize
+			w.Header().Set(limitCappedHeader, strconv.Itoa(limit))
+		}
+		limit = max(1, limit)
+	}
+
+	if offset, err = queryInt(req, "offset", 0); err != nil {
+		return 0, 0, err
+	}
+	if offset < 0 {
+		return 0, 0, fmt.Errorf("invalid offset %d: can't be negative", offset)
+	}
+
+	return limit, offset, nil
+}
+
+// setPaginationLinks adds an RFC 8288 Link header with first/prev/next/last pages. prev is left out on the
+// first page and next on the last one. the links keep the request's other query params (filters etc.)
+func setPaginationLinks(w http.ResponseWriter, req *http.Request, meta PageMeta) {
+	lastOffset := 0
+	if meta.Total > 0 {
+		lastOffset = (meta.Total - 1) / meta.Limit * meta.Limit
+	}
+
+	link := func(rel string, offset int) string {
+		u := *req.URL
+		query := u.Query()
+		query.Set("limit", strconv.Itoa(meta.Limit))
+		query.Set("offset", strconv.Itoa(offset))
+		u.RawQuery = query.Encode()
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.RequestURI(), rel)
+	}
+
+	links := []string{link("first", 0)}
+	if meta.Offset > 0 {
+		links = append(links, link("prev", max(0, meta.Offset-meta.Limit)))
+	}
+	if meta.Offset+meta.Limit < meta.Total {
+		links = append(links, link("next", meta.Offset+meta.Limit))
+	}
+	links = append(links, link("last", lastOffset))
+
+	// Add, the unversioned alias has already set its successor-version link
+	w.Header().Add("Link", strings.Join(links, ", "))
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// the unversioned list keeps the successor-version link deprecated() set next to the pagination links
+func TestUnversionedListKeepsSuccessorLink(t *testing.T) {
+	h := newTestServer(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b"}, Account{ID: 2, FirstName: "c", LastName: "d"}), nil).routes()
+
+	rec := serve(h, http.MethodGet, "/account?limit=1", "")
+	wantResponse(t, rec, http.StatusOK)
+
+	links := strings.Join(rec.Header().Values("Link"), ", ")
+	for _, want := range []string{`</v1/account>; rel="successor-version"`, `rel="first"`, `rel="next"`, `rel="last"`} {
+		if !strings.Contains(links, want) {
+			t.Errorf("Link %q doesn't have %s", links, want)
+		}
+	}
+}
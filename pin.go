@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPINLength = 4
+	maxPINLength = 12
+)
+
+// validatePIN checks that pin is all digits and a sensible length
+func validatePIN(pin string) error {
+	if len(pin) < minPINLength || len(pin) > maxPINLength {
+		return fmt.Errorf("pin must be between %d and %d digits", minPINLength, maxPINLength)
+	}
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return fmt.Errorf("pin must only contain digits")
+		}
+	}
+	return nil
+}
+
+// hashPIN returns the bcrypt hash of pin. Only the hash is ever stored, never the raw PIN
+func hashPIN(pin string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// comparePIN reports whether pin matches the stored bcrypt hash
+func comparePIN(hash, pin string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pin))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// request fields tagged `protected:"admin"` can only be changed by requests carrying the admin token. a regular
+// client sending one back unchanged (a GET, edit, PUT round trip) is fine, changing it is a 403. new fields
+// that shouldn't be self-service (status, limits, ...) only need the tag
+
+// changedProtectedFields returns the JSON names of the protected fields whose value differs between before
+// and after, two values of the same struct type. a nil pointer in after means "leave as is" and isn't a change
+func changedProtectedFields(before, after any) []string {
+	b, a := reflect.ValueOf(before), reflect.ValueOf(after)
+	var changed []string
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if field.Tag.Get("protected") != "admin" {
+			continue
+		}
+		av, bv := a.Field(i), b.Field(i)
+		if av.Kind() == reflect.Pointer {
+			if av.IsNil() {
+				continue
+			}
+			av = av.Elem()
+			if bv.IsNil() {
+				bv = reflect.Zero(av.Type())
+			} else {
+				bv = bv.Elem()
+			}
+		}
+		if !reflect.DeepEqual(av.Interface(), bv.Interface()) {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// checkProtectedFields rejects the update from before to after unless it leaves every protected field alone
+// or the request carries the admin token
+func (s *APIServer) checkProtectedFields(req *http.Request, before, after any) error {
+	changed := changedProtectedFields(before, after)
+	if len(changed) == 0 || s.requireAdmin(req) == nil {
+		return nil
+	}
+
+	fields := make(map[string]string, len(changed))
+	for _, name := range changed {
+		fields[name] = "can only be changed with the admin token"
+	}
+	return &statusError{Status: http.StatusForbidden, Code: CodeForbidden, Fields: fields,
+		Msg: fmt.Sprintf("only admins can change %s, send %s", strings.Join(changed, ", "), adminTokenHeader)}
+}
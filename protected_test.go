@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProtectedBalance(t *testing.T) {
+	cfg := &Config{AdminToken: "secret"}
+	admin := []string{adminTokenHeader, "secret"}
+	patch := []string{"Content-Type", mergePatchContentType}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		hdr    []string
+		status int
+	}{
+		{"PUT changing the balance", http.MethodPut, "/v1/account/1", `{"firstName":"a","lastName":"b","balance":999}`, nil, http.StatusForbidden},
+		{"PUT with the balance unchanged", http.MethodPut, "/v1/account/1", `{"firstName":"a","lastName":"b","balance":100}`, nil, http.StatusOK},
+		{"PUT without a balance", http.MethodPut, "/v1/account/1", `{"firstName":"x","lastName":"y"}`, nil, http.StatusOK},
+		{"admin PUT changing the balance", http.MethodPut, "/v1/account/1", `{"firstName":"a","lastName":"b","balance":999}`, admin, http.StatusOK},
+		{"PATCH changing the balance", http.MethodPatch, "/v1/account/1", `{"balance":999}`, patch, http.StatusForbidden},
+		{"PATCH with the balance unchanged", http.MethodPatch, "/v1/account/1", `{"balance":100}`, patch, http.StatusOK},
+		{"admin PATCH changing the balance", http.MethodPatch, "/v1/account/1", `{"balance":999}`, append(admin, patch...), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 100})
+			h := newTestServer(store, cfg).routes()
+
+			rec := serve(h, tt.method, tt.path, tt.body, tt.hdr...)
+			if tt.status == http.StatusForbidden {
+				wantResponse(t, rec, tt.status, `"code":"FORBIDDEN"`)
+				if store.accs[1].Balance != 100 {
+					t.Fatal("the store changed after a 403")
+				}
+				return
+			}
+			wantResponse(t, rec, tt.status)
+		})
+	}
+}
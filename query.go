@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// typed readers for query parameters. a missing (or empty) parameter gives back the default, a malformed one
+// an error that makeHTTPHandleFunc turns into a 400 naming the parameter and what it expected. numbers that
+// don't fit come back as OUT_OF_RANGE so clients can tell them apart from typos
+
+// queryString returns ?name=, or def when it's missing
+func queryString(req *http.Request, name, def string) string {
+	if v := req.URL.Query().Get(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// queryInt reads ?name= as a whole number
+func queryInt(req *http.Request, name string, def int) (int, error) {
+	n, err := queryInt64(req, name, int64(def))
+	if err == nil && int64(int(n)) != n {
+		return 0, newCodedError(http.StatusBadRequest, CodeOutOfRange, "%s %d is out of range", name, n)
+	}
+	return int(n), err
+}
+
+// queryInt64 reads ?name= as a whole number, for amounts in minor units
+func queryInt64(req *http.Request, name string, def int64) (int64, error) {
+	v := req.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, newCodedError(http.StatusBadRequest, CodeOutOfRange, "%s %s is out of range", name, v)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: must be a whole number", name, v)
+	}
+	return n, nil
+}
+
+// queryBool reads ?name= as true/false (1/0, t/f and the other spellings strconv.ParseBool takes work too)
+func queryBool(req *http.Request, name string, def bool) (bool, error) {
+	v := req.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: must be true or false", name, v)
+	}
+	return b, nil
+}
+
+// queryTime reads ?name= as an RFC 3339 timestamp, a plain date (midnight UTC) or a relative time like -7d,
+// see parseFilterTime. there's no sensible default time, so a missing parameter is nil
+func queryTime(req *http.Request, name string) (*time.Time, error) {
+	v := req.URL.Query().Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := parseFilterTime(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: must be a date (2024-01-31), an RFC 3339 timestamp or a relative time (-7d, -12h, -30m)", name, v)
+	}
+	return &t, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryInt(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+		code  ErrorCode // "" means no error
+	}{
+		{"", 7, ""},
+		{"?n=", 7, ""},
+		{"?n=42", 42, ""},
+		{"?n=-3", -3, ""},
+		{"?n=4.5", 0, CodeBadRequest},
+		{"?n=abc", 0, CodeBadRequest},
+		{"?n=1e3", 0, CodeBadRequest},
+		{"?n=%20", 0, CodeBadRequest},
+		{"?n=99999999999999999999", 0, CodeOutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := queryInt(httptest.NewRequest("GET", "/"+tt.query, nil), "n", 7)
+			checkQueryErr(t, err, tt.code)
+			if err == nil && got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryInt64(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int64
+		code  ErrorCode
+	}{
+		{"", -1, ""},
+		{"?n=9223372036854775807", 9223372036854775807, ""},
+		{"?n=-9223372036854775808", -9223372036854775808, ""},
+		{"?n=9223372036854775808", 0, CodeOutOfRange},
+		{"?n=12abc", 0, CodeBadRequest},
+		{"?n=+", 0, CodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := queryInt64(httptest.NewRequest("GET", "/"+tt.query, nil), "n", -1)
+			checkQueryErr(t, err, tt.code)
+			if err == nil && got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryBool(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+		code  ErrorCode
+	}{
+		{"", true, ""},
+		{"?b=false", false, ""},
+		{"?b=0", false, ""},
+		{"?b=TRUE", true, ""},
+		{"?b=t", true, ""},
+		{"?b=yes", false, CodeBadRequest},
+		{"?b=2", false, CodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := queryBool(httptest.NewRequest("GET", "/"+tt.query, nil), "b", true)
+			checkQueryErr(t, err, tt.code)
+			if err == nil && got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryTime(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string // RFC 3339, "" for nil
+		code  ErrorCode
+	}{
+		{"", "", ""},
+		{"?at=2024-01-31", "2024-01-31T00:00:00Z", ""},
+		{"?at=2024-01-31T10:20:30%2B02:00", "2024-01-31T08:20:30Z", ""},
+		{"?at=2024-02-30", "", CodeBadRequest},
+		{"?at=31/01/2024", "", CodeBadRequest},
+		{"?at=-7x", "", CodeBadRequest},
+		{"?at=yesterday", "", CodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := queryTime(httptest.NewRequest("GET", "/"+tt.query, nil), "at")
+			checkQueryErr(t, err, tt.code)
+			if err != nil {
+				return
+			}
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("got %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.UTC().Format(time.RFC3339) != tt.want {
+				t.Fatalf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryTimeRelative(t *testing.T) {
+	got, err := queryTime(httptest.NewRequest("GET", "/?at=-2h", nil), "at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(*got) - 2*time.Hour; d < 0 || d > time.Minute {
+		t.Fatalf("-2h gave %v, %v off", got, d)
+	}
+}
+
+// checkQueryErr fails the test unless err has code, or is nil when code is empty
+func checkQueryErr(t *testing.T, err error, code ErrorCode) {
+	t.Helper()
+	switch {
+	case code == "" && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case code != "" && err == nil:
+		t.Fatalf("no error, want %s", code)
+	case code != "" && errorCode(err) != code:
+		t.Fatalf("error %v has code %s, want %s", err, errorCode(err), code)
+	}
+}
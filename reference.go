@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// maxReferenceLength caps ?reference= on a transfer batch, it's a key the client generates (ex. a UUID), not a memo
+const maxReferenceLength = 100
+
+// ErrReferenceInUse is what TransferBatch returns when the reference already belongs to a batch from another account
+var ErrReferenceInUse = errors.New("transfer reference already used")
+
+// createTransferReferencesTable stores the result of every completed batch that came with a reference, so a retry
+// with the same reference gets that result back instead of moving the money again. the UNIQUE constraint is what
+// stops two retries racing each other from both going through
+func (s *PostgresStore) createTransferReferencesTable() error {
+	query := `CREATE TABLE IF NOT EXISTS transfer_references (
+		reference VARCHAR(100) NOT NULL UNIQUE,
+		from_account_id INT NOT NULL,
+		result JSONB
+	);`
+	_, err := s.db.Exec(query)
+	return err
+}
+
+// claimReference takes reference for a batch from fromID, first thing in TransferBatch's transaction. nil, nil means
+// it's ours and the batch goes ahead. when the unique constraint says a batch already used it, its stored result
+// comes back instead. a batch still running with the same reference holds the row until it ends: if it commits
+// we get its result, if it rolls back (rejected) the reference is free again and this batch runs
+func claimReference(ctx context.Context, tx querier, reference string, fromID int) (*TransferBatchResult, error) {
+	var claimed bool
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO transfer_references (reference, from_account_id)
+		VALUES ($1, $2)
+		ON CONFLICT (reference) DO NOTHING
+		RETURNING true;
+	`, reference, fromID).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// under READ COMMITTED this statement sees the row the conflicting batch committed
+	var owner int
+	var stored []byte
+	err = tx.QueryRowContext(ctx, `SELECT from_account_id, result FROM transfer_references WHERE reference = $1;`, reference).
+		Scan(&owner, &stored)
+	if err != nil {
+		return nil, err
+	}
+	if owner != fromID {
+		return nil, fmt.Errorf("%w: %q is a transfer from account %d", ErrReferenceInUse, reference, owner)
+	}
+
+	var result TransferBatchResult
+	if err := json.Unmarshal(stored, &result); err != nil {
+		return nil, fmt.Errorf("stored result of transfer %q: %w", reference, err)
+	}
+	result.Replayed = true
+	return &result, nil
+}
+
+// saveReferenceResult fills in the result of the batch that claimed reference, in the transaction that moved the money
+func saveReferenceResult(ctx context.Context, tx querier, reference string, result *TransferBatchResult) error {
+	stored, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE transfer_references SET result = $2 WHERE reference = $1;`, reference, stored)
+	return err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultReadRetries  = 2
+	defaultRetryBackoff = 50 * time.Millisecond
+	defaultQueryTimeout = 5 * time.Second
+
+	// maxRetryBackoff caps the backoff however many attempts there were and however big DB_RETRY_BACKOFF is
+	maxRetryBackoff = 5 * time.Second
+)
+
+// withReadRetry runs op and retries it with jittered exponential backoff while it fails with a transient connection error.
+// ONLY use this for idempotent reads, a write that errored mid-flight may still have committed on the server.
+// it stops early once ctx is done, there's no point retrying past the deadline
+func (s *PostgresStore) withReadRetry(ctx context.Context, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		// in a TxStore the transaction went down with the connection, a retry can't get it back
+		if err == nil || attempt >= s.readRetries || !isTransientDBError(err) || s.tx != nil {
+			return err
+		}
+
+		if !s.sleepBackoff(ctx, attempt) {
+			return err
+		}
+	}
+}
+
+// retryDelay is how long to wait after attempt (0 for the first) failed: retryBackoff doubled per attempt, up
+// to maxRetryBackoff. "equal jitter" then picks between half and all of it so retries from many requests spread out
+func (s *PostgresStore) retryDelay(attempt int) time.Duration {
+	backoff := maxRetryBackoff
+	// compared before shifting, retryBackoff << attempt can overflow into a negative that rand.N panics on
+	if attempt < 63 && s.retryBackoff <= maxRetryBackoff>>attempt {
+		backoff = s.retryBackoff << attempt
+	}
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// sleepBackoff waits out retryDelay(attempt). it returns false, right away, once ctx is done, there's no
+// point retrying past the deadline
+func (s *PostgresStore) sleepBackoff(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(s.retryDelay(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// maxCreateAttempts bounds how often withCreateRetry runs a create, the first attempt included
+const maxCreateAttempts = 3
+
+// withCreateRetry runs op, a whole create transaction, again (after sleepBackoff, like withReadRetry) when it
+// loses a race: a serialization failure or deadlock, or a duplicate account number (ex. the sequence was reset
+// or a number was inserted by hand, nextval itself never repeats). op has to start a fresh transaction each
+// time. every other error comes back right away
+func (s *PostgresStore) withCreateRetry(ctx context.Context, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		// a lost race in a TxStore is the whole transaction's to retry, not this one call's
+		if err == nil || attempt+1 >= maxCreateAttempts || !isRetryableCreateError(err) || s.tx != nil {
+			return err
+		}
+
+		if !s.sleepBackoff(ctx, attempt) {
+			return err
+		}
+	}
+}
+
+// isRetryableCreateError reports whether a create failed in a way a fresh attempt can get past
+func isRetryableCreateError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == accountNumberIndex { // unique_violation
+		return true
+	}
+	return isConflictError(err)
+}
+
+// startOp gives a store operation its deadline: ctx as is if the caller already set one, otherwise ctx with
+// queryTimeout added. the returned func (defer it) releases the context and, if the deadline (or Postgres'
+// statement_timeout) is what made the operation fail, wraps *errp in ErrQueryTimeout
+func (s *PostgresStore) startOp(ctx context.Context, errp *error) (context.Context, func()) {
+	cancel := context.CancelFunc(func() {})
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline && s.queryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.queryTimeout)
+	}
+
+	return ctx, func() {
+		ctxErr := ctx.Err() // before cancel, which would make it Canceled
+		cancel()
+		timedOut := errors.Is(ctxErr, context.DeadlineExceeded) || (ctxErr == nil && isStatementTimeout(*errp))
+		if *errp != nil && timedOut && !errors.Is(*errp, ErrQueryTimeout) {
+			*errp = fmt.Errorf("%w: %v", ErrQueryTimeout, *errp)
+		}
+	}
+}
+
+// isStatementTimeout reports whether Postgres canceled the statement itself because of DB_STATEMENT_TIMEOUT.
+// the same code comes back when we cancel a query because its context ended, that case is told apart by ctx.Err()
+func isStatementTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "57014" // query_canceled
+}
+
+// isTransientDBError reports whether err looks like a connection blip worth retrying.
+// anything else (no rows, constraint violations, bad SQL, ...) is a real failure and must not be retried
+func isTransientDBError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code.Class() == "08": // connection_exception
+			return true
+		case pqErr.Code == "57P01", pqErr.Code == "57P02", pqErr.Code == "57P03": // admin/crash shutdown, cannot_connect_now
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isConflictError reports whether err means the write lost a race with another transaction
+// (serialization_failure or deadlock_detected). the API answers these with a 409 so the client can retry
+func isConflictError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// unreachableStore is a PostgresStore whose database is never contacted: sql.Open doesn't connect, and with
+// the context already over database/sql gives up before dialing
+func unreachableStore(t *testing.T) *PostgresStore {
+	t.Helper()
+	db, err := sql.Open("postgres", "postgres://gobank@127.0.0.1:1/gobank?sslmode=disable&connect_timeout=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &PostgresStore{db: db, readRetries: defaultReadRetries, retryBackoff: defaultRetryBackoff, queryTimeout: defaultQueryTimeout}
+}
+
+func TestExpiredContextIsQueryTimeout(t *testing.T) {
+	store := unreachableStore(t)
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	start := time.Now()
+	_, err := store.GetAccountByID(ctx, 1)
+	if !errors.Is(err, ErrQueryTimeout) {
+		t.Fatalf("err = %v, want %v", err, ErrQueryTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("took %v, an expired context should fail right away", elapsed)
+	}
+}
+
+func TestExpiredContextIs504(t *testing.T) {
+	h := newTestServer(unreachableStore(t), nil).routes()
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/account/1", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	wantResponse(t, rec, http.StatusGatewayTimeout, `"code":"TIMEOUT"`)
+}
+
+func TestIsRetryableCreateError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"deadlock", &pq.Error{Code: "40P01"}, true},
+		{"duplicate number", &pq.Error{Code: "23505", Constraint: accountNumberIndex}, true},
+		{"wrapped duplicate number", fmt.Errorf("create: %w", &pq.Error{Code: "23505", Constraint: accountNumberIndex}), true},
+		{"duplicate name", &pq.Error{Code: "23505", Constraint: accountNameIndex}, false},
+		{"check violation", &pq.Error{Code: "23514"}, false},
+		{"connection lost", &pq.Error{Code: "08006"}, false}, // might have committed, a retry could create it twice
+		{"plain error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableCreateError(tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCreateRetryGivesUp(t *testing.T) {
+	store := &PostgresStore{retryBackoff: time.Millisecond}
+	attempts := 0
+	err := store.withCreateRetry(context.Background(), func() error {
+		attempts++
+		return &pq.Error{Code: "40001"}
+	})
+	if err == nil || attempts != maxCreateAttempts {
+		t.Fatalf("err = %v after %d attempts, want a failure after %d", err, attempts, maxCreateAttempts)
+	}
+
+	attempts = 0
+	err = store.withCreateRetry(context.Background(), func() error {
+		attempts++
+		return &pq.Error{Code: "23514"}
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("err = %v after %d attempts, want a failure without retries", err, attempts)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		base    time.Duration
+		attempt int
+		max     time.Duration
+	}{
+		{50 * time.Millisecond, 0, 50 * time.Millisecond},
+		{50 * time.Millisecond, 3, 400 * time.Millisecond},
+		{50 * time.Millisecond, 10, maxRetryBackoff},
+		{50 * time.Millisecond, 62, maxRetryBackoff},
+		{50 * time.Millisecond, 100, maxRetryBackoff}, // a shift this big is 0 or overflows
+		{1000 * time.Hour, 1, maxRetryBackoff},
+		{1000 * time.Hour, 40, maxRetryBackoff},
+		{0, 5, 0},
+	}
+	for _, tt := range tests {
+		store := &PostgresStore{retryBackoff: tt.base}
+		for range 20 {
+			got := store.retryDelay(tt.attempt)
+			if got < tt.max/2 || got > tt.max {
+				t.Fatalf("retryDelay(%d) with base %v = %v, want between %v and %v", tt.attempt, tt.base, got, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestSleepBackoffStopsWithContext(t *testing.T) {
+	store := &PostgresStore{retryBackoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if store.sleepBackoff(ctx, 50) {
+		t.Fatal("sleepBackoff outlived its context")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("took %v to notice the context ended", elapsed)
+	}
+}
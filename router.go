@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// methods is the set of handlers one path supports, keyed by HTTP method. each path in handleAccountRouter
+// declares one of these so OPTIONS and 405s come out the same everywhere
+type methods map[string]func() error
+
+// allow lists the supported methods for the Allow header, OPTIONS included since every path answers it
+// and HEAD wherever there's a GET
+func (m methods) allow() string {
+	list := []string{http.MethodOptions}
+	for method := range m {
+		list = append(list, method)
+	}
+	if _, ok := m[http.MethodGet]; ok {
+		list = append(list, http.MethodHead)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// serve runs the handler for req.Method. OPTIONS gets a 204 with the Allow header, HEAD runs the GET
+// handler (makeHTTPHandleFunc already dropped the body), anything not in the set gets a 405 with the Allow header
+func (m methods) serve(w http.ResponseWriter, req *http.Request) error {
+	if req.Method == http.MethodOptions {
+		w.Header().Set("Allow", m.allow())
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	method := req.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	handler, ok := m[method]
+	if !ok {
+		w.Header().Set("Allow", m.allow())
+		return newStatusError(http.StatusMethodNotAllowed, "method %s not allowed on %s", req.Method, req.URL.Path)
+	}
+	return handler()
+}
+
+// headResponseWriter answers a HEAD request: headers and status go out as the GET handler set them
+// (Content-Length included), the body is thrown away
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
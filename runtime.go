@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// RuntimeResponse is GET /admin/runtime, a quick look at the process without a metrics stack
+type RuntimeResponse struct {
+	StartedAt      time.Time           `json:"startedAt"`
+	UptimeSeconds  int64               `json:"uptimeSeconds"`
+	TotalRequests  int64               `json:"totalRequests"`  // every request since startup, including active ones
+	ActiveRequests int64               `json:"activeRequests"` // requests being handled right now, this one included
+	Goroutines     int                 `json:"goroutines"`
+	Breaker        string              `json:"breaker,omitempty"` // database circuit breaker state, when there is one
+	Cache          *CacheStatsResponse `json:"cache,omitempty"`   // account cache counters, when there is one
+}
+
+// CacheStatsResponse is how often GET /account/{id} was answered from the account cache since startup
+type CacheStatsResponse struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// handleRuntime reports request counters and uptime (admin only)
+func (s *APIServer) handleRuntime(w http.ResponseWriter, req *http.Request) error {
+	return methods{
+		http.MethodGet: func() error {
+			if err := s.requireAdmin(req); err != nil {
+				return err
+			}
+
+			resp := RuntimeResponse{
+				StartedAt:      s.startedAt,
+				UptimeSeconds:  int64(time.Since(s.startedAt).Seconds()),
+				TotalRequests:  s.totalRequests.Load(),
+				ActiveRequests: s.activeRequests.Load(),
+				Goroutines:     runtime.NumGoroutine(),
+			}
+			if s.breaker != nil {
+				resp.Breaker = s.breaker.BreakerState()
+			}
+			if s.cache != nil {
+				hits, misses := s.cache.CacheStats()
+				resp.Cache = &CacheStatsResponse{Hits: hits, Misses: misses}
+			}
+			return WriteJSON(w, http.StatusOK, resp)
+		},
+	}.serve(w, req)
+}
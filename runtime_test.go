@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeCacheStats(t *testing.T) {
+	cache := NewCachedStore(newMemStore(Account{ID: 1, FirstName: "a", LastName: "b"}), 10)
+	s := newTestServer(cache, &Config{AdminToken: "secret"})
+	s.cache = cache
+	h := s.routes()
+
+	serve(h, http.MethodGet, "/v1/account/1", "") // miss
+	serve(h, http.MethodGet, "/v1/account/1", "") // hit
+	serve(h, http.MethodGet, "/v1/account/1", "") // hit
+
+	runtime := makeHTTPHandleFunc(s.handleRuntime)
+	wantResponse(t, serve(runtime, http.MethodGet, "/admin/runtime", "", adminTokenHeader, "secret"), http.StatusOK,
+		`"cache":{"hits":2,"misses":1}`)
+
+	// no cache, no cache section
+	s.cache = nil
+	rec := serve(runtime, http.MethodGet, "/admin/runtime", "", adminTokenHeader, "secret")
+	wantResponse(t, rec, http.StatusOK)
+	if body := rec.Body.String(); strings.Contains(body, `"cache"`) {
+		t.Fatalf("cache stats without a cache: %s", body)
+	}
+}
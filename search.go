@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// accountNameExpr is what name search matches against. the trigram index is built on this exact expression,
+// so the query has to use it verbatim for Postgres to pick the index
+const accountNameExpr = `(COALESCE(first_name, '') || ' ' || COALESCE(last_name, ''))`
+
+// maxSearchQueryLength keeps search terms to something a person would type
+const maxSearchQueryLength = 100
+
+// createNameSearchIndex enables pg_trgm and adds the trigram index used by SearchAccounts
+func (s *PostgresStore) createNameSearchIndex() error {
+	queries := []string{
+		// in public explicitly, with DB_SCHEMA set it would otherwise land in whichever instance created it first
+		// and be out of every other instance's search_path
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm SCHEMA public;`,
+		`CREATE INDEX IF NOT EXISTS accounts_name_trgm_idx ON accounts USING GIN (` + accountNameExpr + ` gin_trgm_ops);`,
+	}
+	for _, query := range queries {
+		if _, err := s.db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchAccounts finds accounts whose name is similar to q, best match first. it uses word similarity so a
+// partial word (what a type-ahead sends) still matches the whole name ("jo" finds "John Smith")
+func (s *PostgresStore) SearchAccounts(ctx context.Context, q string, limit int) (_ []Account, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	query := `
+		SELECT id, first_name, last_name, number, balance, currency, created_at, updated_at
+		FROM accounts
+		WHERE $1 <% ` + accountNameExpr + `
+		ORDER BY word_similarity($1, ` + accountNameExpr + `) DESC, id
+		LIMIT $2;
+	`
+
+	var accounts []Account
+	err = s.withReadRetry(ctx, func() error {
+		rows, err := s.q().QueryContext(ctx, query, q, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		accounts = []Account{}
+		for rows.Next() {
+			var acc Account
+			if err := scanAccount(rows, &acc); err != nil {
+				return err
+			}
+			accounts = append(accounts, acc)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+type AccountSearchResponse struct {
+	Data []AccountResponse `json:"data"`
+}
+
+// handleSearchAccounts is GET /account/search?q=john, ?limit= works like on the list endpoint
+func (s *APIServer) handleSearchAccounts(w http.ResponseWriter, req *http.Request) error {
+	q := strings.TrimSpace(req.URL.Query().Get("q"))
+	if q == "" {
+		return fmt.Errorf("missing search query, use ?q=")
+	}
+	if utf8.RuneCountInString(q) > maxSearchQueryLength {
+		return fmt.Errorf("search query is too long, the maximum is %d characters", maxSearchQueryLength)
+	}
+
+	limit, _, err := s.parsePagination(w, req)
+	if err != nil {
+		return err
+	}
+
+	accounts, err := s.store.SearchAccounts(req.Context(), q, limit)
+	if err != nil {
+		return err
+	}
+
+	resp := AccountSearchResponse{Data: make([]AccountResponse, 0, len(accounts))}
+	for i := range accounts {
+		r := toAccountResponse(&accounts[i])
+		s.forClient(req, &r)
+		resp.Data = append(resp.Data, r)
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const defaultShutdownTimeout = 15 * time.Second
+
+// Shutdown stops accepting connections and gives in-flight requests up to timeout to finish. whatever is
+// still running when the timeout runs out, or as soon as something arrives on force (a second SIGTERM),
+// is cut off. it logs how many requests were drained and how many aborted
+func (s *APIServer) Shutdown(timeout time.Duration, force <-chan os.Signal) {
+	inFlight := s.activeRequests.Load()
+	slog.Info("shutting down, draining in-flight requests", "inFlight", inFlight, "timeout", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-force:
+			slog.Warn("got a second signal, closing without waiting", "signal", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var aborted int64
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		aborted = s.activeRequests.Load()
+		s.httpServer.Close() // drops the connections that are still busy
+	}
+	slog.Info("shutdown done", "drained", max(0, inFlight-aborted), "aborted", aborted)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxStatementRange is the widest period one statement may cover, a year (leap years included)
+	maxStatementRange = 366 * 24 * time.Hour
+
+	// defaultStatementRange is how far back a statement without ?from goes
+	defaultStatementRange = 30 * 24 * time.Hour
+)
+
+// ErrNoBalanceHistory is wrapped by GetStatement and BalanceAsOf when there's no balance to report at that time,
+// because the account didn't exist yet or the audit log doesn't go back that far
+var ErrNoBalanceHistory = errors.New("no balance history")
+
+// Statement is GET /account/{id}/statement: the balance at From, every balance change up to To, and the
+// balance at To. From is inclusive, To exclusive
+type Statement struct {
+	AccountID      int                `json:"accountID"`
+	Currency       string             `json:"currency"`
+	From           time.Time          `json:"from"`
+	To             time.Time          `json:"to"`
+	OpeningBalance int64              `json:"openingBalance"`
+	ClosingBalance int64              `json:"closingBalance"`
+	Summary        TransactionSummary `json:"summary"`
+	Entries        []StatementEntry   `json:"entries"`
+}
+
+// TransactionSummary totals the entries of a statement. Debits is positive, Net is Credits - Debits,
+// which is also ClosingBalance - OpeningBalance
+type TransactionSummary struct {
+	Credits int64 `json:"credits"`
+	Debits  int64 `json:"debits"`
+	Net     int64 `json:"net"`
+}
+
+// StatementEntry is one balance change on a statement, oldest first. Amount is negative when money went out,
+// Balance is the balance right after it
+type StatementEntry struct {
+	ID      int64     `json:"id"` // the audit log entry it comes from
+	Action  string    `json:"action"`
+	Amount  int64     `json:"amount"`
+	Balance int64     `json:"balance"`
+	At      time.Time `json:"at"`
+}
+
+// GetStatement returns the statement of account id for [from, to). there's no transactions table, it's read from
+// the audit log: every create, update and transfer records the balance before and after it. the opening balance
+// is the last one recorded before from, or 0 if the account was opened inside the range. amounts are the running
+// difference from there, so they always add up to ClosingBalance - OpeningBalance
+func (s *PostgresStore) GetStatement(ctx context.Context, id int, from, to time.Time) (_ *Statement, err error) {
+	ctx, done := s.startOp(ctx, &err)
+	defer done()
+
+	accountQuery := `
+		SELECT a.currency, a.created_at, (
+			SELECT (l.after->>'balance')::bigint
+			FROM audit_log l
+			WHERE l.account_id = a.id AND l.at < $2 AND l.after ? 'balance'
+			ORDER BY l.at DESC, l.id DESC
+			LIMIT 1
+		)
+		FROM accounts a
+		WHERE a.id = $1;
+	`
+	// entries that didn't move the balance (ex. a rename) aren't on a statement
+	entriesQuery := `
+		SELECT id, action, (after->>'balance')::bigint, (before->>'balance')::bigint, at
+		FROM audit_log
+		WHERE account_id = $1 AND at >= $2 AND at < $3
+		  AND after ? 'balance'
+		  AND (after->'balance') IS DISTINCT FROM (before->'balance')
+		ORDER BY at, id;
+	`
+
+	statement := &Statement{AccountID: id, From: from, To: to}
+	var createdAt time.Time
+	var opening sql.NullInt64
+	// the balance before the first entry in the range, for accounts older than the audit log
+	var firstBefore sql.NullInt64
+	err = s.withReadRetry(ctx, func() error {
+		if err := s.q().QueryRowContext(ctx, accountQuery, id, from).Scan(&statement.Currency, &createdAt, &opening); err != nil {
+			return err
+		}
+
+		rows, err := s.q().QueryContext(ctx, entriesQuery, id, from, to)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		statement.Entries = []StatementEntry{}
+		for rows.Next() {
+			var e StatementEntry
+			var before sql.NullInt64
+			if err := rows.Scan(&e.ID, &e.Action, &e.Balance, &before, &e.At); err != nil {
+				return err
+			}
+			if len(statement.Entries) == 0 {
+				firstBefore = before
+			}
+			e.At = e.At.UTC()
+			statement.Entries = append(statement.Entries, e)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w with id %d", ErrAccountNotFound, id)
+		}
+		return nil, err
+	}
+
+	switch {
+	case opening.Valid:
+		statement.OpeningBalance = opening.Int64
+	case !createdAt.Before(from):
+		// opened inside the range, its create entry is the first one on the statement
+	case firstBefore.Valid:
+		statement.OpeningBalance = firstBefore.Int64
+	default:
+		return nil, fmt.Errorf("%w: the audit log has no balance for account %d before %s", ErrNoBalanceHistory, id, from.Format(time.RFC3339))
+	}
+
+	balance := statement.OpeningBalance
+	for i := range statement.Entries {
+		statement.Entries[i].Amount = statement.Entries[i].Balance - balance
+		balance = statement.Entries[i].Balance
+	}
+	statement.ClosingBalance = balance
+	statement.Summary = summarizeEntries(statement.Entries)
+	return statement, nil
+}
+
+// summarizeEntries adds up the money in and out of a statement. it's summed from the entries GetStatement
+// already read, not in a separate query, so a transfer committing in between can't make the two disagree
+func summarizeEntries(entries []StatementEntry) TransactionSummary {
+	var summary TransactionSummary
+	for _, e := range entries {
+		if e.Amount > 0 {
+			summary.Credits += e.Amount
+		} else {
+			summary.Debits -= e.Amount
+		}
+	}
+	summary.Net = summary.Credits - summary.Debits
+	return summary
+}
+
+// handleGetStatement answers GET /account/{id}/statement?from=&to=. from and to take the same formats as the list
+// filters, to defaults to now and from to 30 days before to. a to that's a date includes that whole day, so
+// from=2024-01-01&to=2024-01-31 is all of January. with asPDF (/statement.pdf) or Accept: application/pdf the
+// same statement is sent as a PDF instead
+func (s *APIServer) handleGetStatement(w http.ResponseWriter, req *http.Request, id int, asPDF bool) error {
+	from, to, err := parseStatementRange(req)
+	if err != nil {
+		return err
+	}
+
+	statement, err := s.store.GetStatement(req.Context(), id, from, to)
+	if errors.Is(err, ErrNoBalanceHistory) {
+		return &statusError{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Msg: err.Error(),
+			Fields: map[string]string{"from": "is before the account's balance history starts"}}
+	}
+	if err != nil {
+		return err
+	}
+
+	if asPDF || acceptsPDF(req) {
+		return s.writeStatementPDF(w, req, statement)
+	}
+	return WriteJSON(w, http.StatusOK, statement)
+}
+
+// parseStatementRange reads ?from and ?to into a UTC [from, to) no wider than maxStatementRange
+func parseStatementRange(req *http.Request) (from, to time.Time, err error) {
+	fromParam, err := queryTime(req, "from")
+	if err != nil {
+		return from, to, err
+	}
+
+	to = time.Now().UTC()
+	toParam, err := queryTime(req, "to")
+	if err != nil {
+		return from, to, err
+	}
+	if toParam != nil {
+		to = toParam.UTC()
+		if _, err := time.Parse(time.DateOnly, req.URL.Query().Get("to")); err == nil {
+			to = to.AddDate(0, 0, 1)
+		}
+	}
+
+	from = to.Add(-defaultStatementRange)
+	if fromParam != nil {
+		from = fromParam.UTC()
+	}
+
+	if !to.After(from) {
+		return from, to, fmt.Errorf("to (%s) must be after from (%s)", to.Format(time.RFC3339), from.Format(time.RFC3339))
+	}
+	if to.Sub(from) > maxStatementRange {
+		return from, to, fmt.Errorf("a statement covers at most %d days, ask for several", int(maxStatementRange/(24*time.Hour)))
+	}
+	return from, to, nil
+}
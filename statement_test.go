@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatementRange(t *testing.T) {
+	jan1 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query    string
+		from, to time.Time
+		wantErr  bool
+	}{
+		{"?from=2024-01-01&to=2024-01-31", jan1, jan1.AddDate(0, 1, 0), false}, // a date to takes the whole day
+		{"?from=2024-01-01&to=2024-01-31T12:00:00Z", jan1, time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC), false},
+		{"?from=2024-01-01T00:00:00%2B02:00&to=2024-01-02", jan1.Add(-2 * time.Hour), jan1.AddDate(0, 0, 2), false},
+		{"?from=2024-01-01&to=2024-12-31", jan1, jan1.AddDate(1, 0, 0), false},  // 366 days, 2024 is a leap year
+		{"?to=2024-01-31", jan1.AddDate(0, 0, 1), jan1.AddDate(0, 1, 0), false}, // 30 days back from to
+		{"?from=2024-01-01&to=2025-01-01", time.Time{}, time.Time{}, true},
+		{"?from=2024-01-31&to=2024-01-01", time.Time{}, time.Time{}, true},
+		{"?from=2024-01-01T00:00:00Z&to=2024-01-01T00:00:00Z", time.Time{}, time.Time{}, true},
+		{"?from=2024-01-01", time.Time{}, time.Time{}, true}, // to is now, over a year later
+		{"?from=january&to=2024-01-31", time.Time{}, time.Time{}, true},
+		{"?from=2024-01-01&to=31/01/2024", time.Time{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			from, to, err := parseStatementRange(httptest.NewRequest("GET", "/"+tt.query, nil))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got [%v, %v), want an error", from, to)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !from.Equal(tt.from) || !to.Equal(tt.to) || from.Location() != time.UTC || to.Location() != time.UTC {
+				t.Fatalf("got [%v, %v), want [%v, %v) in UTC", from, to, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestStatementDefaultsToLast30Days(t *testing.T) {
+	before := time.Now()
+	from, to, err := parseStatementRange(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.Before(before) || to.After(time.Now()) {
+		t.Fatalf("to = %v, want now", to)
+	}
+	if d := to.Sub(from); d != defaultStatementRange {
+		t.Fatalf("range is %v long, want %v", d, defaultStatementRange)
+	}
+}
+
+func TestSummarizeEntries(t *testing.T) {
+	entries := []StatementEntry{{Amount: 100}, {Amount: -30}, {Amount: 5}, {Amount: -20}}
+	got := summarizeEntries(entries)
+	if want := (TransactionSummary{Credits: 105, Debits: 50, Net: 55}); got != want {
+		t.Fatalf("summary = %+v, want %+v", got, want)
+	}
+	if got := summarizeEntries([]StatementEntry{}); got != (TransactionSummary{}) {
+		t.Fatalf("summary of nothing = %+v, want zeroes", got)
+	}
+}
+
+// the transactions link in _links is a statement URL that works as it is
+func TestTransactionsLink(t *testing.T) {
+	h := newTestServer(newMemStore(Account{ID: 1, Balance: 5}), nil).routes()
+
+	rec := serve(h, http.MethodGet, "/v1/account/1", "", "Accept", "application/json; profile=links")
+	wantResponse(t, rec, http.StatusOK, `"transactions":{"href":"http://example.com/v1/account/1/statement"}`)
+
+	wantResponse(t, serve(h, http.MethodGet, "/v1/account/1/statement", ""), http.StatusOK, `"openingBalance":5`)
+}
+
+func TestGetStatement(t *testing.T) {
+	h := newTestServer(newMemStore(Account{ID: 1, Balance: 250, Currency: "EUR"}), nil).routes()
+
+	rec := serve(h, http.MethodGet, "/v1/account/1/statement?from=2024-01-01&to=2024-01-31", "")
+	wantResponse(t, rec, http.StatusOK, `"accountID":1`, `"currency":"EUR"`, `"from":"2024-01-01T00:00:00Z"`,
+		`"to":"2024-02-01T00:00:00Z"`, `"openingBalance":250`, `"closingBalance":250`, `"summary":{"credits":0,"debits":0,"net":0}`, `"entries":[]`)
+
+	rec = serve(h, http.MethodGet, "/v1/account/2/statement?from=-30d", "")
+	wantResponse(t, rec, http.StatusNotFound, `"code":"ACCOUNT_NOT_FOUND"`)
+
+	rec = serve(h, http.MethodGet, "/v1/account/1/statement?to=2024-01-01&from=2024-02-01", "")
+	wantResponse(t, rec, http.StatusBadRequest, "must be after from")
+
+	rec = serve(h, http.MethodPost, "/v1/account/1/statement?from=-30d", "")
+	wantResponse(t, rec, http.StatusMethodNotAllowed)
+}
+
+func TestGetStatementPDF(t *testing.T) {
+	h := newTestServer(newMemStore(Account{ID: 1, FirstName: "Zoë", LastName: "Smith", Balance: 250, Currency: "EUR"}), nil).routes()
+
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"statement.pdf": serve(h, http.MethodGet, "/v1/account/1/statement.pdf?from=2024-01-01&to=2024-01-31", ""),
+		"Accept":        serve(h, http.MethodGet, "/v1/account/1/statement?from=2024-01-01&to=2024-01-31", "", "Accept", "application/pdf"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/pdf" {
+				t.Fatalf("Content-Type = %q, want application/pdf", ct)
+			}
+			if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename=statement-1-2024-01-01-2024-01-31.pdf` {
+				t.Fatalf("Content-Disposition = %q", cd)
+			}
+			if !strings.HasPrefix(rec.Body.String(), "%PDF-") {
+				t.Fatalf("body doesn't start like a PDF: %.20q", rec.Body.String())
+			}
+		})
+	}
+
+	// errors stay JSON
+	rec := serve(h, http.MethodGet, "/v1/account/2/statement.pdf?from=-30d", "")
+	wantResponse(t, rec, http.StatusNotFound, `"code":"ACCOUNT_NOT_FOUND"`)
+}
+
+func TestRenderStatementPDF(t *testing.T) {
+	at := time.Date(2024, 1, 10, 9, 30, 0, 0, time.UTC)
+	statement := &Statement{AccountID: 1, Currency: "JPY", From: at.AddDate(0, 0, -9), To: at.AddDate(0, 0, 1),
+		OpeningBalance: 0, ClosingBalance: 700, Summary: TransactionSummary{Credits: 1000, Debits: 300, Net: 700},
+		Entries: []StatementEntry{{ID: 1, Action: "create", Amount: 1000, Balance: 1000, At: at}, {ID: 2, Action: "transfer", Amount: -300, Balance: 700, At: at}}}
+
+	var buf bytes.Buffer
+	if err := renderStatementPDF(&buf, statement, "Zoë Smith", "******7890"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF-")) {
+		t.Fatalf("not a PDF: %.20q", buf.String())
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// TxStore is an AccountStore whose calls all run in one database transaction. nothing it does is visible to
+// anyone else until Commit, and Rollback throws all of it away. it holds a connection until one of them is
+// called, so always defer Rollback (a no-op after Commit). a write that fails undoes only its own changes, but
+// any other database error leaves the transaction aborted and only good for Rollback. there are no retries
+// on connection errors or lost races inside one. it isn't safe for concurrent use
+type TxStore interface {
+	AccountStore
+	Commit() error
+	Rollback() error
+}
+
+// TxBeginner is implemented by stores that can run several calls in one transaction. it's optional, stores that
+// can't (fakes, caches, ...) just don't implement it, so check with a type assertion:
+//
+//	if b, ok := s.store.(TxBeginner); ok { tx, err := b.BeginTx(ctx) ... }
+type TxBeginner interface {
+	BeginTx(ctx context.Context) (TxStore, error)
+}
+
+var (
+	// ErrNestedTx is what BeginTx on a TxStore returns, there's one transaction per TxStore
+	ErrNestedTx = errors.New("already in a transaction")
+	// ErrTxUnsupported is what a wrapper's BeginTx returns when the store it wraps isn't a TxBeginner
+	ErrTxUnsupported = errors.New("the store doesn't support transactions")
+)
+
+// querier is what both *sql.DB and *sql.Tx run queries with, so store code can run inside or outside a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// opTx is the transaction a single store method works in: a real one, or a savepoint inside a TxStore's
+type opTx interface {
+	querier
+	Commit() error
+	Rollback() error
+}
+
+// BeginTx starts a transaction and returns a view of the store that runs every call in it
+func (s *PostgresStore) BeginTx(ctx context.Context) (TxStore, error) {
+	if s.tx != nil {
+		return nil, ErrNestedTx
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	view := *s
+	view.tx = tx
+	return &postgresTx{&view}, nil
+}
+
+// postgresTx is the TxStore of PostgresStore: the same store with tx set
+type postgresTx struct {
+	*PostgresStore
+}
+
+func (t *postgresTx) Commit() error   { return t.tx.Commit() }
+func (t *postgresTx) Rollback() error { return t.tx.Rollback() }
+
+// q is what store methods run their queries on, the TxStore's transaction if there is one
+func (s *PostgresStore) q() querier {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// begin starts the transaction for one store method. in a TxStore it's a savepoint instead: the method's own
+// Commit releases it and its Rollback undoes only what the method did, so a failed call leaves the outer
+// transaction usable and the caller decides whether to go on or roll everything back
+func (s *PostgresStore) begin(ctx context.Context) (opTx, error) {
+	if s.tx == nil {
+		return s.db.BeginTx(ctx, nil)
+	}
+	if _, err := s.tx.ExecContext(ctx, "SAVEPOINT store_op"); err != nil {
+		return nil, err
+	}
+	return &savepointTx{Tx: s.tx, ctx: ctx}, nil
+}
+
+// savepointTx is a store method's opTx inside a TxStore. methods run one at a time, so one savepoint name is enough
+type savepointTx struct {
+	*sql.Tx
+	ctx  context.Context
+	done bool
+}
+
+func (t *savepointTx) Commit() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	_, err := t.Tx.ExecContext(t.ctx, "RELEASE SAVEPOINT store_op")
+	return err
+}
+
+// Rollback undoes the method's changes, like sql.Tx.Rollback it's a no-op (returning ErrTxDone) after Commit
+func (t *savepointTx) Rollback() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	// even if the method's context is over, the outer transaction has to be left usable
+	ctx := context.WithoutCancel(t.ctx)
+	if _, err := t.Tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT store_op"); err != nil {
+		return err
+	}
+	_, err := t.Tx.ExecContext(ctx, "RELEASE SAVEPOINT store_op")
+	return err
+}
@@ -1,23 +1,142 @@
 package main
 
 import (
+	"encoding/json"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type CreateAccountRequest struct {
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
+	FirstName string `json:"firstName" validate:"required,min=1,max=50,cleantext"`
+	LastName  string `json:"lastName" validate:"required,min=1,max=50,cleantext"`
+	Currency  string `json:"currency" validate:"omitempty,len=3,alpha"`     // optional, defaults to USD
+	PIN       string `json:"pin" validate:"omitempty,numeric,min=4,max=12"` // optional, only its bcrypt hash is stored
+
+	// optional opening deposit in minor units, capped so a typo can't create an absurd balance
+	InitialBalance int64 `json:"initialBalance" validate:"min=0,max=100000000000"`
+
+	// optional, an opening transfer from an existing account. the account is only created if it goes through
+	Funding *AccountFunding `json:"funding,omitempty"`
+}
+
+// AccountFunding is the opening transfer of a new account, Amount is in the new account's currency
+type AccountFunding struct {
+	FromAccountID int   `json:"fromAccountID" validate:"required"`
+	Amount        int64 `json:"amount" validate:"min=1,max=100000000000"`
 }
 
 type UpdateAccountRequest struct {
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
-	Balance   int64  `json:"balance"`
+	FirstName string `json:"firstName" validate:"required,min=1,max=50,cleantext"`
+	LastName  string `json:"lastName" validate:"required,min=1,max=50,cleantext"`
+
+	// a pointer so a missing balance (nil, left as is) isn't the same as "balance": 0 (set to zero)
+	// protected, setting a balance by hand is an admin correction. everyone else moves money with transfers
+	Balance *int64 `json:"balance" validate:"omitempty,min=0" protected:"admin"`
+}
+
+// BalancesRequest is the body of POST /account/balances
+type BalancesRequest struct {
+	IDs []int `json:"ids" validate:"required,min=1,max=100,dive,min=1,max=2147483647"`
+}
+
+// BalancesResponse is POST /account/balances: the balances found, in the order they were asked for,
+// and the ids that don't exist
+type BalancesResponse struct {
+	Data    []BalanceResponse `json:"data"`
+	Missing []int             `json:"missing"`
 }
 
 type BalanceResponse struct {
-	ID      int   `json:"id"`
-	Balance int64 `json:"balance"`
+	ID             int        `json:"id"`
+	Balance        int64      `json:"balance"`
+	Currency       string     `json:"currency,omitempty"`
+	BalanceDisplay string     `json:"balanceDisplay,omitempty"` // only set with ?format=display
+	AsOf           *time.Time `json:"asOf,omitempty"`           // only set with ?asOf=
+
+	stringNumbers bool // marshal balance as a JSON string, see MarshalJSON
+}
+
+// MarshalJSON writes balance as a JSON string instead of a number when stringNumbers is set.
+// JavaScript clients lose precision on integers above 2^53, a string keeps the exact value
+func (b BalanceResponse) MarshalJSON() ([]byte, error) {
+	type plain BalanceResponse // same fields without the MarshalJSON method, so this doesn't recurse
+	if !b.stringNumbers {
+		return json.Marshal(plain(b))
+	}
+	return json.Marshal(struct {
+		plain
+		Balance string `json:"balance"` // shallower than the embedded field, so it replaces it
+	}{plain(b), strconv.FormatInt(b.Balance, 10)})
+}
+
+// TransferEntry is one leg of a batch transfer, moving Amount from the source account to ToAccountID
+type TransferEntry struct {
+	ToAccountID int   `json:"toAccountID"`
+	Amount      int64 `json:"amount"`
+
+	// the currency Amount is in, optional. it has to match the source account's unless Convert is set,
+	// then Amount is converted to the source's currency first
+	Currency string `json:"currency,omitempty"`
+	Convert  bool   `json:"convert,omitempty"`
+}
+
+// TransferResult reports what happened to a single entry of a batch transfer
+type TransferResult struct {
+	Index       int       `json:"index"`
+	ToAccountID int       `json:"toAccountID"`
+	Amount      int64     `json:"amount"`
+	Status      string    `json:"status"` // "ok", "failed" or "skipped" (another entry made an atomic batch fail)
+	Code        ErrorCode `json:"code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+
+	// only for cross-currency entries: what the destination was credited, in its currency, and the rate used
+	ConvertedAmount int64  `json:"convertedAmount,omitempty"`
+	Currency        string `json:"currency,omitempty"`
+	Rate            string `json:"rate,omitempty"`
+
+	// only for entries with convert: what the source was debited, in its currency, and the rate used
+	DebitedAmount int64  `json:"debitedAmount,omitempty"`
+	DebitRate     string `json:"debitRate,omitempty"`
+}
+
+// TransferBatchResult is the combined outcome of a batch transfer.
+// atomic batches are "completed" only if every entry went through, otherwise "rejected" and no money moved.
+// best-effort batches are "completed", "partial" or "failed" depending on how many entries succeeded
+type TransferBatchResult struct {
+	FromAccountID int              `json:"fromAccountID"`
+	Reference     string           `json:"reference,omitempty"`
+	Mode          string           `json:"mode"`
+	Status        string           `json:"status"`
+	Succeeded     int              `json:"succeeded,omitempty"` // best-effort only
+	Failed        int              `json:"failed,omitempty"`    // best-effort only
+	Code          ErrorCode        `json:"code,omitempty"`
+	Error         string           `json:"error,omitempty"`
+	TotalAmount   int64            `json:"totalAmount"`
+	Balance       int64            `json:"balance"` // source balance after the batch (unchanged if rejected)
+	Results       []TransferResult `json:"results"`
+
+	// what the source can still send today, only set when the batch went over its daily limit
+	RemainingLimit *int64 `json:"remainingLimit,omitempty"`
+
+	// set when the reference matched an earlier batch: this is that batch's result, nothing moved this time
+	Replayed bool `json:"replayed,omitempty"`
+
+	Changes []BalanceChange `json:"-"` // every balance the batch changed, for notifying subscribers
+}
+
+// BalanceChange records an account's balance before and after a write
+type BalanceChange struct {
+	AccountID int
+	Previous  int64
+	Current   int64
+}
+
+// GroupRow is one bucket of the balance report (ex. every account with last name "Smith")
+type GroupRow struct {
+	Group        string `json:"group"`
+	Count        int64  `json:"count"`
+	TotalBalance int64  `json:"totalBalance"`
 }
 
 type Account struct {
@@ -26,6 +145,97 @@ type Account struct {
 	LastName  string    `json:"lastName"`
 	Number    int64     `json:"number"`
 	Balance   int64     `json:"balance"`
+	Currency  string    `json:"currency"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
 }
+
+// AccountResponse is the client-facing shape of an Account. Account maps the DB row and can pick up
+// internal columns over time, so handlers only ever write this DTO and fields have to be opted in here
+type AccountResponse struct {
+	ID        int       `json:"id"`
+	FirstName string    `json:"firstName"`
+	LastName  string    `json:"lastName"`
+	Number    int64     `json:"number"`
+	Balance   int64     `json:"balance"`
+	Currency  string    `json:"currency"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	BalanceDisplay string `json:"balanceDisplay,omitempty"` // only set with ?format=display
+
+	Links *AccountLinks `json:"_links,omitempty"` // only set for clients that asked for links, see accountLinks
+
+	stringNumbers bool // marshal number and balance as JSON strings, see MarshalJSON
+	maskNumber    bool // marshal number as a masked string that only shows the last 4 digits, see MarshalJSON
+}
+
+// AccountLinks points at what a client can do with an account next
+type AccountLinks struct {
+	Self         Link `json:"self"`
+	Balance      Link `json:"balance"`
+	Transfer     Link `json:"transfer"`
+	Audit        Link `json:"audit"`
+	Transactions Link `json:"transactions"` // the statement, the last 30 days unless the client adds ?from/?to
+}
+
+type Link struct {
+	Href string `json:"href"`
+}
+
+// MarshalJSON writes number and balance as JSON strings instead of numbers when stringNumbers is set.
+// JavaScript clients lose precision on integers above 2^53, a string keeps the exact value.
+// with maskNumber set the number is written masked (ex. "******7890") whatever stringNumbers says
+func (a AccountResponse) MarshalJSON() ([]byte, error) {
+	type plain AccountResponse // same fields without the MarshalJSON method, so this doesn't recurse
+	if !a.stringNumbers && !a.maskNumber {
+		return json.Marshal(plain(a))
+	}
+
+	var number, balance any = a.Number, a.Balance
+	if a.stringNumbers {
+		number, balance = strconv.FormatInt(a.Number, 10), strconv.FormatInt(a.Balance, 10)
+	}
+	if a.maskNumber {
+		number = maskAccountNumber(a.Number)
+	}
+	return json.Marshal(struct {
+		plain
+		Number  any `json:"number"` // shallower than the embedded fields, so these replace them
+		Balance any `json:"balance"`
+	}{plain(a), number, balance})
+}
+
+// maskAccountNumber hides every digit of an account number but the last 4 (ex. 1234567890 => "******7890")
+func maskAccountNumber(number int64) string {
+	digits := strconv.FormatInt(number, 10)
+	visible := min(4, len(digits)-1) // always hide at least one digit, even on a very short number
+	return strings.Repeat("*", len(digits)-visible) + digits[len(digits)-visible:]
+}
+
+// AccountListResponse is one page of GET /account
+type AccountListResponse struct {
+	Data []AccountResponse `json:"data"`
+	Meta PageMeta          `json:"meta"`
+}
+
+// PageMeta describes the page a list response holds
+type PageMeta struct {
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// toAccountResponse maps the internal Account model to the DTO we send to clients
+func toAccountResponse(acc *Account) AccountResponse {
+	return AccountResponse{
+		ID:        acc.ID,
+		FirstName: acc.FirstName,
+		LastName:  acc.LastName,
+		Number:    acc.Number,
+		Balance:   acc.Balance,
+		Currency:  acc.Currency,
+		CreatedAt: acc.CreatedAt,
+		UpdatedAt: acc.UpdatedAt,
+	}
+}
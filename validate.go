@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// validate checks request structs against their `validate:"..."` tags. It's safe for concurrent use and caches
+// struct info, so there's one for the whole server
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+
+	// report fields by their JSON name (firstName) rather than the Go one (FirstName) so clients recognise them
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	// "cleantext": valid UTF-8 with no control characters, see isCleanText
+	v.RegisterValidation("cleantext", func(fl validator.FieldLevel) bool {
+		return isCleanText(fl.Field().String())
+	})
+
+	return v
+}
+
+// isCleanText reports whether s is valid UTF-8 without control characters (null bytes, newlines, escapes, ...).
+// encoding/json swaps invalid UTF-8 for U+FFFD while decoding, so by the time a request struct gets validated
+// a bad byte sequence shows up as that replacement character and is rejected as well
+func isCleanText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeAndValidate decodes the JSON request body into a T (see decodeJSON) and validates it against T's struct tags.
+// failed validation comes back as a 422 listing the message for every bad field
+func decodeAndValidate[T any](req *http.Request) (*T, error) {
+	v, err := decodeJSON[T](req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateRequest(v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// validateRequest checks v against its struct tags, failures come back as a 422 listing the message for every bad field
+func validateRequest(v any) error {
+	if err := validate.Struct(v); err != nil {
+		var fieldErrs validator.ValidationErrors
+		if !errors.As(err, &fieldErrs) {
+			return err
+		}
+
+		fields := make(map[string]string, len(fieldErrs))
+		for _, fe := range fieldErrs {
+			fields[fe.Field()] = fieldErrorMessage(fe)
+		}
+		return &statusError{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Msg: "validation failed", Fields: fields}
+	}
+	return nil
+}
+
+// fieldErrorMessage turns a failed validation rule into a short human readable message
+func fieldErrorMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		switch fe.Kind() {
+		case reflect.String:
+			return fmt.Sprintf("must be at least %s characters", fe.Param())
+		case reflect.Slice:
+			return fmt.Sprintf("must have at least %s items", fe.Param())
+		}
+		return fmt.Sprintf("must be at least %s", fe.Param())
+	case "max":
+		switch fe.Kind() {
+		case reflect.String:
+			return fmt.Sprintf("must be at most %s characters", fe.Param())
+		case reflect.Slice:
+			return fmt.Sprintf("must have at most %s items", fe.Param())
+		}
+		return fmt.Sprintf("must be at most %s", fe.Param())
+	case "len":
+		return fmt.Sprintf("must be exactly %s characters", fe.Param())
+	case "cleantext":
+		return "must be valid UTF-8 without control characters"
+	case "numeric":
+		return "must only contain digits"
+	case "alpha":
+		return "must only contain letters"
+	case "email":
+		return "must be a valid email address"
+	default:
+		return fmt.Sprintf("failed %q validation", fe.Tag())
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIsCleanText(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"Ana", true},
+		{"José Müller-O'Brien", true},
+		{"李小龙", true},
+		{"", true},
+		{"a\x00b", false},
+		{"a\nb", false},
+		{"a\tb", false},
+		{"\x1b[31mred", false},
+		{"a\u0085b", false}, // C1 control
+		{"\xff\xfe", false},
+		{"a\xc3", false}, // truncated sequence
+		{"a�b", false},
+	}
+	for _, tt := range tests {
+		if got := isCleanText(tt.in); got != tt.want {
+			t.Errorf("isCleanText(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDirtyNamesRejected(t *testing.T) {
+	for name, body := range map[string]string{
+		"escaped null byte": `{"firstName":"a\u0000b","lastName":"c"}`,
+		"raw invalid UTF-8": "{\"firstName\":\"a\xffb\",\"lastName\":\"c\"}",
+		"escaped newline":   `{"firstName":"a","lastName":"c\nd"}`,
+		"lone surrogate":    `{"firstName":"a\ud800","lastName":"c"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := newTestServer(newMemStore(), nil).routes()
+			wantResponse(t, serve(h, http.MethodPost, "/v1/account", body), http.StatusUnprocessableEntity,
+				`"code":"VALIDATION_FAILED"`, "must be valid UTF-8 without control characters")
+		})
+	}
+}
+
+func TestNegativeBalanceRejected(t *testing.T) {
+	admin := []string{adminTokenHeader, "secret"}
+	tests := []struct {
+		name, method, path, body string
+		hdr                      []string
+		field                    string
+	}{
+		{"PUT", http.MethodPut, "/v1/account/1", `{"firstName":"a","lastName":"b","balance":-100}`, admin, "balance"},
+		{"PUT without the admin token", http.MethodPut, "/v1/account/1", `{"firstName":"a","lastName":"b","balance":-100}`, nil, "balance"},
+		{"PATCH", http.MethodPatch, "/v1/account/1", `{"balance":-1}`, append([]string{"Content-Type", mergePatchContentType}, admin...), "balance"},
+		{"POST", http.MethodPost, "/v1/account", `{"firstName":"a","lastName":"b","initialBalance":-100}`, admin, "initialBalance"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore(Account{ID: 1, FirstName: "a", LastName: "b", Balance: 100})
+			h := newTestServer(store, &Config{AdminToken: "secret"}).routes()
+
+			rec := serve(h, tt.method, tt.path, tt.body, tt.hdr...)
+			wantResponse(t, rec, http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`, `"fields":{"`+tt.field+`":`)
+			if store.accs[1].Balance != 100 {
+				t.Fatalf("balance changed to %d", store.accs[1].Balance)
+			}
+		})
+	}
+}
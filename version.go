@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+)
+
+// build info, set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+// (the Makefile does this). plain go build leaves the defaults
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+
+	// what new account numbers look like, so clients can validate what users type in
+	AccountNumber AccountNumberFormatInfo `json:"accountNumber"`
+}
+
+// AccountNumberFormatInfo describes AccountNumberFormat to clients
+type AccountNumberFormatInfo struct {
+	AccountNumberFormat
+	CheckDigit string `json:"checkDigit"` // always "luhn", the last digit
+}
+
+// handleVersion says which build is running and the account number format it hands out. like /ready it
+// isn't behind basic auth, it's cheap and doesn't touch the database
+func (s *APIServer) handleVersion(w http.ResponseWriter, req *http.Request) {
+	WriteJSON(w, http.StatusOK, VersionResponse{
+		Version:       version,
+		Commit:        commit,
+		BuildDate:     buildDate,
+		AccountNumber: AccountNumberFormatInfo{AccountNumberFormat: s.cfg.AccountNumbers, CheckDigit: "luhn"},
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookQueueSize   = 100
+	webhookMaxAttempts = 5
+	webhookBaseBackoff = time.Second
+	webhookTimeout     = 5 * time.Second
+
+	// webhookSignatureHeader carries "sha256=<hex HMAC of the body>" so receivers can verify the event came from us
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// WebhookEvent is the JSON payload POSTed to the webhook URL
+type WebhookEvent struct {
+	Type      string    `json:"type"` // ex. "account.created", "balance.changed"
+	AccountID int       `json:"accountId"`
+	Data      any       `json:"data"`
+	At        time.Time `json:"at"`
+}
+
+// WebhookDispatcher delivers events to a single configured URL on a background worker so requests never wait on the receiver
+type WebhookDispatcher struct {
+	url    string
+	secret []byte
+	client *http.Client
+	queue  chan WebhookEvent
+}
+
+// NewWebhookDispatcher creates a dispatcher that signs every payload with secret. Call Start to begin delivering.
+func NewWebhookDispatcher(url, secret string) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan WebhookEvent, webhookQueueSize),
+	}
+}
+
+// Start runs the delivery worker in its own goroutine
+func (d *WebhookDispatcher) Start() {
+	go func() {
+		for evt := range d.queue {
+			d.deliverWithRetry(evt)
+		}
+	}()
+}
+
+// HandleEvent is the event bus subscriber for webhooks, it forwards the event types receivers care about
+func (d *WebhookDispatcher) HandleEvent(evt AccountEvent) {
+	switch evt.Type {
+	case EventAccountCreated, EventBalanceChanged:
+		d.Enqueue(WebhookEvent{Type: evt.Type, AccountID: evt.AccountID, Data: evt.Data, At: evt.At})
+	}
+}
+
+// Enqueue schedules evt for delivery without blocking. If the queue is full the event goes straight to the dead-letter log.
+func (d *WebhookDispatcher) Enqueue(evt WebhookEvent) {
+	select {
+	case d.queue <- evt:
+	default:
+		d.deadLetter(evt, 0, fmt.Errorf("queue full"))
+	}
+}
+
+func (d *WebhookDispatcher) deliverWithRetry(evt WebhookEvent) {
+	var err error
+	for attempt := 0; attempt < webhookMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(webhookBaseBackoff << (attempt - 1))
+		}
+		if err = d.deliver(evt); err == nil {
+			return
+		}
+		slog.Warn("webhook delivery failed", "type", evt.Type, "accountID", evt.AccountID,
+			"attempt", attempt+1, "maxAttempts", webhookMaxAttempts, "error", err)
+	}
+	d.deadLetter(evt, webhookMaxAttempts, err)
+}
+
+func (d *WebhookDispatcher) deliver(evt WebhookEvent) error {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, "sha256="+d.sign(body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body using the shared secret
+func (d *WebhookDispatcher) sign(body []byte) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter logs an event we gave up on after attempts deliveries (0 when the queue was full), with the full
+// payload so it can be replayed by hand
+func (d *WebhookDispatcher) deadLetter(evt WebhookEvent, attempts int, reason error) {
+	payload, _ := json.Marshal(evt)
+	slog.Error("webhook dead-letter", "type", evt.Type, "accountID", evt.AccountID,
+		"attempt", attempts, "error", reason, "payload", string(payload))
+}